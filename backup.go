@@ -0,0 +1,271 @@
+package like
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/coyove/bbolt"
+)
+
+// Snapshot format: magic, format version, then a list of namespaces and aliases:
+//
+//	backupBucket, uvarint name length, name, bucket  (namespace)
+//	backupValue, uvarint name length, name, uvarint target length, target  (alias)
+//	backupEnd
+//
+// Buckets are written recursively as: uvarint sequence, entries in the same form
+// as above (nested buckets and key values), backupEnd.
+var backupMagic = []byte("like-ns\x00")
+
+const (
+	backupEnd = iota
+	backupValue
+	backupBucket
+)
+
+// Backup writes a consistent snapshot of all namespaces to w while writes continue.
+// Buckets not managed by DB are not included.
+func (db *DB) Backup(w io.Writer) error {
+	return db.backup(w, "")
+}
+
+// BackupNamespace writes a consistent snapshot of namespace ns to w while writes continue.
+func (db *DB) BackupNamespace(ns string, w io.Writer) error {
+	if ns == "" {
+		return fmt.Errorf("empty namespace")
+	}
+	return db.backup(w, ns)
+}
+
+func (db *DB) backup(w io.Writer, ns string) error {
+	tx, err := db.begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bw := bufio.NewWriter(w)
+	bw.Write(backupMagic)
+	bw.Write(binary.AppendUvarint(nil, formatVersion))
+
+	writeKey := func(kind byte, k []byte) error {
+		buf := binary.AppendUvarint([]byte{kind}, uint64(len(k)))
+		_, err := bw.Write(append(buf, k...))
+		return err
+	}
+
+	if ns != "" {
+		bkNs := getNamespace(tx, ns)
+		if bkNs == nil {
+			return fmt.Errorf("namespace %q not found", ns)
+		}
+		if err := writeKey(backupBucket, []byte(ns)); err != nil {
+			return err
+		}
+		if err := writeBackupBucket(bw, bkNs); err != nil {
+			return err
+		}
+	} else if nss := namespaces(tx); nss != nil {
+		err := nss.ForEachBucket(func(k []byte) error {
+			if err := writeKey(backupBucket, k); err != nil {
+				return err
+			}
+			return writeBackupBucket(bw, nss.Bucket(k))
+		})
+		if err != nil {
+			return err
+		}
+		if aliases := tx.Bucket(rootBucket).Bucket(aliasesBucket); aliases != nil {
+			err := aliases.ForEach(func(k, v []byte) error {
+				if err := writeKey(backupValue, k); err != nil {
+					return err
+				}
+				_, err := bw.Write(append(binary.AppendUvarint(nil, uint64(len(v))), v...))
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	bw.WriteByte(backupEnd)
+	return bw.Flush()
+}
+
+func writeBackupBucket(w *bufio.Writer, bk *bbolt.Bucket) error {
+	var tmp []byte
+	tmp = binary.AppendUvarint(tmp, bk.Sequence())
+	if _, err := w.Write(tmp); err != nil {
+		return err
+	}
+	err := bk.ForEach(func(k, v []byte) error {
+		kind := byte(backupValue)
+		if v == nil {
+			kind = backupBucket
+		}
+		tmp = append(tmp[:0], kind)
+		tmp = binary.AppendUvarint(tmp, uint64(len(k)))
+		tmp = append(tmp, k...)
+		if kind == backupBucket {
+			if _, err := w.Write(tmp); err != nil {
+				return err
+			}
+			return writeBackupBucket(w, bk.Bucket(k))
+		}
+		tmp = binary.AppendUvarint(tmp, uint64(len(v)))
+		tmp = append(tmp, v...)
+		_, err := w.Write(tmp)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return w.WriteByte(backupEnd)
+}
+
+// Restore loads a snapshot written by Backup or BackupNamespace. If ns is empty all
+// namespaces and aliases are restored under their original names, otherwise the
+// snapshot must contain exactly one namespace, which is restored as ns. Existing
+// namespaces are never overwritten. Large snapshots are written in multiple
+// transactions, restored namespaces should not be used before Restore returns,
+// they are dropped if restoring fails.
+func (db *DB) Restore(r io.Reader, ns string) (err error) {
+	rd := bufio.NewReader(r)
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(rd, magic); err != nil || !bytes.Equal(magic, backupMagic) {
+		return fmt.Errorf("invalid snapshot")
+	}
+	version, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return err
+	} else if version > formatVersion {
+		return fmt.Errorf("unsupported format version %d", version)
+	}
+
+	w := &compactWriter{begin: func() (*bbolt.Tx, error) { return db.begin(true) }, txSize: bulkTxPuts}
+	if w.tx, err = w.begin(); err != nil {
+		return err
+	}
+	defer func() { w.tx.Rollback() }()
+	if _, err := createRoot(w.tx); err != nil {
+		return err
+	}
+
+	var restored []string
+	err = func() error {
+		for {
+			kind, err := rd.ReadByte()
+			if err != nil {
+				return err
+			}
+			if kind == backupEnd {
+				return nil
+			}
+			name, err := readBackupBytes(rd)
+			if err != nil {
+				return err
+			}
+			switch kind {
+			case backupBucket:
+				if ns != "" {
+					if len(restored) > 0 {
+						return fmt.Errorf("snapshot contains more than one namespace")
+					}
+					name = []byte(ns)
+				}
+				if getNamespace(w.tx, string(name)) != nil {
+					return fmt.Errorf("namespace %q already exists", name)
+				}
+				restored = append(restored, string(name))
+				if err := readBackupBucket(rd, w, [][]byte{rootBucket, namespacesBucket, name}); err != nil {
+					return fmt.Errorf("namespace %q: %v", name, err)
+				}
+			case backupValue:
+				target, err := readBackupBytes(rd)
+				if err != nil {
+					return err
+				}
+				if ns != "" {
+					continue
+				}
+				if getNamespace(w.tx, string(name)) != nil && string(resolveNamespace(w.tx, string(name))) != string(target) {
+					return fmt.Errorf("namespace %q already exists", name)
+				}
+				if err := w.put([][]byte{rootBucket, aliasesBucket}, name, target); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("invalid entry kind %d", kind)
+			}
+		}
+	}()
+	if err == nil && len(restored) == 0 && ns != "" {
+		err = fmt.Errorf("snapshot contains no namespace")
+	}
+	for _, name := range restored {
+		if err == nil && version < formatVersion {
+			err = upgradeNamespace(namespaces(w.tx).Bucket([]byte(name)))
+		}
+	}
+	if err != nil {
+		w.tx.Rollback()
+		for _, name := range restored {
+			db.DropNamespace(name)
+		}
+		return fmt.Errorf("restore: %v", err)
+	}
+	w.tx.OnCommit(db.resetPercolator)
+	return w.tx.Commit()
+}
+
+func readBackupBytes(rd *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(rd, buf)
+	return buf, err
+}
+
+func readBackupBucket(rd *bufio.Reader, w *compactWriter, path [][]byte) error {
+	seq, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return err
+	}
+	if err := w.setSequence(path, seq); err != nil {
+		return err
+	}
+	for {
+		kind, err := rd.ReadByte()
+		if err != nil {
+			return err
+		}
+		if kind == backupEnd {
+			return nil
+		}
+		k, err := readBackupBytes(rd)
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case backupBucket:
+			if err := readBackupBucket(rd, w, append(path[:len(path):len(path)], k)); err != nil {
+				return err
+			}
+		case backupValue:
+			v, err := readBackupBytes(rd)
+			if err != nil {
+				return err
+			}
+			if err := w.put(path, k, v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid entry kind %d", kind)
+		}
+	}
+}
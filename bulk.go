@@ -0,0 +1,428 @@
+package like
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/coyove/bbolt"
+)
+
+// Bucket tags of non-posting buckets, they sort after all runes.
+const (
+	bulkTagID      = 0xFFFFFFFD
+	bulkTagContent = 0xFFFFFFFE
+	bulkTagIndex   = 0xFFFFFFFF
+
+	bulkTxPuts = 100000
+)
+
+// BulkLoader builds a fresh namespace from a large corpus. Documents are tokenized
+// on all CPU cores, postings are accumulated in memory and spilled to sorted temp
+// files, then every bucket is written exactly once in key order by Finish.
+//
+// Finish writes in multiple transactions. Until the last one commits, the namespace
+// config is marked as loading and searches and writes fail with ErrUnfinishedLoad.
+// If loading is interrupted, the namespace must be dropped before loading again.
+type BulkLoader struct {
+	db          *DB
+	memoryLimit int
+	tempDir     string
+
+	mu       sync.Mutex
+	closeMu  sync.RWMutex // held by Add while sending to work
+	finished bool
+	ids      map[string]bool
+	index    uint64
+	entries  []bulkEntry
+	size     int
+	runs     []string
+	errs     []error
+
+	work chan bulkDoc
+	wg   sync.WaitGroup
+}
+
+type bulkDoc struct {
+	IndexDocument
+	index uint64
+}
+
+type bulkEntry struct {
+	tag        uint32
+	key, value []byte
+}
+
+func (a bulkEntry) less(b bulkEntry) bool {
+	if a.tag != b.tag {
+		return a.tag < b.tag
+	}
+	return bytes.Compare(a.key, b.key) < 0
+}
+
+func (db *DB) NewBulkLoader(memoryLimit int, tempDir string) (*BulkLoader, error) {
+	if err := db.CheckConfig(); err != nil {
+		return nil, err
+	}
+	if total, watermark, err := db.Count(); err != nil {
+		return nil, err
+	} else if total > 0 || watermark > 0 {
+		return nil, fmt.Errorf("namespace %q is not empty", db.Namespace)
+	}
+	if memoryLimit <= 0 {
+		memoryLimit = 256 << 20
+	}
+
+	l := &BulkLoader{
+		db:          db,
+		memoryLimit: memoryLimit,
+		tempDir:     tempDir,
+		ids:         map[string]bool{},
+		work:        make(chan bulkDoc, runtime.NumCPU()*4),
+	}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		l.wg.Add(1)
+		go l.worker()
+	}
+	return l, nil
+}
+
+func (l *BulkLoader) Add(doc IndexDocument) error {
+	if len(doc.ID) == 0 {
+		return fmt.Errorf("empty document ID")
+	}
+	if len(doc.ID) > bbolt.MaxKeySize {
+		return fmt.Errorf("document ID too large")
+	}
+	if doc.Rescore {
+		return fmt.Errorf("rescore is not supported in bulk loading")
+	}
+
+	l.mu.Lock()
+	if l.ids[string(doc.ID)] {
+		l.mu.Unlock()
+		return fmt.Errorf("duplicated document ID %x", doc.ID)
+	}
+	l.ids[string(doc.ID)] = true
+	index := l.index
+	l.index++
+	l.mu.Unlock()
+
+	l.closeMu.RLock()
+	defer l.closeMu.RUnlock()
+	if l.finished {
+		return fmt.Errorf("bulk loader is finished")
+	}
+	l.work <- bulkDoc{doc, index}
+	return nil
+}
+
+func (l *BulkLoader) worker() {
+	defer l.wg.Done()
+	for doc := range l.work {
+		entries, err := l.collect(doc)
+		l.mu.Lock()
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("document %x: %v", doc.ID, err))
+			l.mu.Unlock()
+			continue
+		}
+		l.entries = append(l.entries, entries...)
+		for _, e := range entries {
+			l.size += len(e.key) + len(e.value) + 40
+		}
+		var spill []bulkEntry
+		if l.size > l.memoryLimit {
+			spill, l.entries, l.size = l.entries, nil, 0
+		}
+		l.mu.Unlock()
+
+		if spill != nil {
+			l.spill(spill)
+		}
+	}
+}
+
+func (l *BulkLoader) collect(doc bulkDoc) ([]bulkEntry, error) {
+	content, err := l.db.encodeContent(doc.Content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document content: %v", err)
+	}
+	chars, _ := Collect(doc.Content, l.db.maxChars())
+	if len(chars) == 0 {
+		return nil, fmt.Errorf("empty document")
+	}
+	chars[0] = nil
+
+	kl, score := l.db.config().keyLayout(), doc.score()
+	if err := kl.check(score, doc.Secondary); err != nil {
+		return nil, err
+	}
+	payload, err := kl.encodePayload(doc.index, score, doc.Secondary, chars)
+	if err != nil {
+		return nil, err
+	}
+
+	key := kl.postingKey(score, doc.Secondary, doc.index)
+	entries := make([]bulkEntry, 0, len(chars)+3)
+	for r, v := range chars {
+		entries = append(entries, bulkEntry{uint32(r), key, v})
+	}
+	entries = append(entries, bulkEntry{bulkTagID, doc.ID, payload}, bulkEntry{bulkTagIndex, key[kl.prefixLen():], doc.ID})
+	if !l.db.IndexOnly {
+		entries = append(entries, bulkEntry{bulkTagContent, doc.ID, content})
+	}
+	return entries, nil
+}
+
+func (l *BulkLoader) spill(entries []bulkEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].less(entries[j]) })
+
+	err := func() error {
+		f, err := os.CreateTemp(l.tempDir, "like-bulk-*")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		l.mu.Lock()
+		l.runs = append(l.runs, f.Name())
+		l.mu.Unlock()
+
+		w := bufio.NewWriter(f)
+		var tmp []byte
+		for _, e := range entries {
+			tmp = binary.BigEndian.AppendUint32(tmp[:0], e.tag)
+			tmp = binary.AppendUvarint(tmp, uint64(len(e.key)))
+			tmp = append(tmp, e.key...)
+			tmp = binary.AppendUvarint(tmp, uint64(len(e.value)))
+			tmp = append(tmp, e.value...)
+			if _, err := w.Write(tmp); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}()
+	if err != nil {
+		l.mu.Lock()
+		l.errs = append(l.errs, fmt.Errorf("spill: %v", err))
+		l.mu.Unlock()
+	}
+}
+
+// Finish waits for all added documents to be tokenized and writes the namespace.
+// It returns all errors met during loading, documents which failed are skipped.
+func (l *BulkLoader) Finish() error {
+	l.closeMu.Lock()
+	if l.finished {
+		l.closeMu.Unlock()
+		return fmt.Errorf("bulk loader is finished")
+	}
+	l.finished = true
+	close(l.work)
+	l.closeMu.Unlock()
+	l.wg.Wait()
+
+	defer func() {
+		for _, run := range l.runs {
+			os.Remove(run)
+		}
+	}()
+
+	sort.Slice(l.entries, func(i, j int) bool { return l.entries[i].less(l.entries[j]) })
+
+	var h bulkHeap
+	if len(l.entries) > 0 {
+		h = append(h, &bulkRun{entries: l.entries})
+	}
+	for _, run := range l.runs {
+		f, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h = append(h, &bulkRun{rd: bufio.NewReader(f)})
+	}
+	for i := 0; i < len(h); i++ {
+		if err := h[i].next(); err != nil {
+			return err
+		}
+		if h[i].eof {
+			h = append(h[:i], h[i+1:]...)
+			i--
+		}
+	}
+	heap.Init(&h)
+
+	if err := l.write(&h); err != nil {
+		return err
+	}
+	return errors.Join(l.errs...)
+}
+
+func (l *BulkLoader) write(h *bulkHeap) error {
+	db := l.db
+	tx, err := db.begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { tx.Rollback() }()
+
+	bkNs, err := db.createNamespace(tx, db.Namespace)
+	if err == nil {
+		_, err = db.checkConfig(bkNs)
+	}
+	if err != nil {
+		return err
+	}
+	loading := db.config()
+	loading.Loading = true
+	if err := bkNs.Put(configKey, loading.marshal()); err != nil {
+		return err
+	}
+
+	var bk *bbolt.Bucket
+	var name []byte
+	var tag uint32
+	var puts, count int
+
+	finishBucket := func() {
+		if bk == nil {
+			return
+		}
+		switch tag {
+		case bulkTagID:
+			bk.SetSequence(l.index)
+		case bulkTagContent:
+		default:
+			bk.SetSequence(bk.Sequence() + uint64(count))
+		}
+		count = 0
+	}
+
+	for h.Len() > 0 {
+		run := (*h)[0]
+		e := run.cur
+
+		if bk == nil || e.tag != tag {
+			finishBucket()
+			tag = e.tag
+			switch tag {
+			case bulkTagID:
+				name = idBucket
+			case bulkTagContent:
+				name = contentBucket
+			case bulkTagIndex:
+				name = indexBucket
+			default:
+				name = runeBucket(tag)
+			}
+			if bk, err = bkNs.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+			bk.FillPercent = 1
+		}
+
+		if err := bk.Put(e.key, e.value); err != nil {
+			return err
+		}
+		count++
+
+		if puts++; puts%bulkTxPuts == 0 {
+			finishBucket()
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			if tx, err = db.begin(true); err != nil {
+				return err
+			}
+			bkNs = db.namespace(tx)
+			bk = bkNs.Bucket(name)
+			bk.FillPercent = 1
+		}
+
+		if err := run.next(); err != nil {
+			return err
+		}
+		if run.eof {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	finishBucket()
+
+	bkNs.Bucket(idBucket).SetSequence(l.index)
+	if err := bkNs.Put(configKey, db.config().marshal()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type bulkRun struct {
+	entries []bulkEntry
+	rd      *bufio.Reader
+	cur     bulkEntry
+	eof     bool
+}
+
+func (r *bulkRun) next() error {
+	if r.rd == nil {
+		if len(r.entries) == 0 {
+			r.eof = true
+			return nil
+		}
+		r.cur, r.entries = r.entries[0], r.entries[1:]
+		return nil
+	}
+
+	var tag [4]byte
+	if _, err := io.ReadFull(r.rd, tag[:]); err == io.EOF {
+		r.eof = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r.cur.tag = binary.BigEndian.Uint32(tag[:])
+
+	read := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r.rd)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r.rd, buf)
+		return buf, err
+	}
+	var err error
+	if r.cur.key, err = read(); err != nil {
+		return err
+	}
+	r.cur.value, err = read()
+	return err
+}
+
+type bulkHeap []*bulkRun
+
+func (h bulkHeap) Len() int { return len(h) }
+
+func (h bulkHeap) Less(i, j int) bool { return h[i].cur.less(h[j].cur) }
+
+func (h bulkHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *bulkHeap) Push(x any) { *h = append(*h, x.(*bulkRun)) }
+
+func (h *bulkHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
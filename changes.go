@@ -0,0 +1,216 @@
+package like
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/coyove/bbolt"
+	"github.com/dop251/scsu"
+)
+
+var changeActions = []string{"index", "rescore", "delete", "evict"}
+
+type Change struct {
+	Seq       uint64
+	Action    string
+	ID        []byte
+	Score     uint32 // capped at math.MaxUint32, see Score64
+	Score64   uint64
+	Secondary uint64
+	// Content is empty if the document was indexed with DB.IndexOnly.
+	Content string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("Change(%d, %s, %x, %d, %d, %db)", c.Seq, c.Action, c.ID, c.score(), c.Secondary, len(c.Content))
+}
+
+func (c Change) score() uint64 {
+	if c.Score64 != 0 {
+		return c.Score64
+	}
+	return uint64(c.Score)
+}
+
+// Records with scores over 32 bits or secondary keys set changeWide in the action
+// byte and store both as 8 bytes, others store a 4-byte score.
+const changeWide = 0x80
+
+func (c Change) marshal() []byte {
+	buf := make([]byte, 1, 1+binary.MaxVarintLen64+len(c.ID)+16+len(c.Content))
+	for i, a := range changeActions {
+		if a == c.Action {
+			buf[0] = byte(i)
+		}
+	}
+	score := c.score()
+	wide := score > math.MaxUint32 || c.Secondary != 0
+	if wide {
+		buf[0] |= changeWide
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(c.ID)))
+	buf = append(buf, c.ID...)
+	if wide {
+		buf = binary.BigEndian.AppendUint64(buf, score)
+		buf = binary.BigEndian.AppendUint64(buf, c.Secondary)
+	} else {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(score))
+	}
+	buf, _ = scsu.Encode(c.Content, buf)
+	return buf
+}
+
+func (c *Change) unmarshal(seq, buf []byte) error {
+	if len(seq) != 8 || len(buf) < 1 || int(buf[0]&^changeWide) >= len(changeActions) {
+		return fmt.Errorf("invalid change record")
+	}
+	c.Seq = binary.BigEndian.Uint64(seq)
+	c.Action = changeActions[buf[0]&^changeWide]
+	scoreLen := uint64(4)
+	if buf[0]&changeWide != 0 {
+		scoreLen = 16
+	}
+	idLen, w := binary.Uvarint(buf[1:])
+	if w <= 0 || uint64(len(buf[1+w:])) < idLen+scoreLen {
+		return fmt.Errorf("invalid change record #%d", c.Seq)
+	}
+	buf = buf[1+w:]
+	c.ID = append([]byte(nil), buf[:idLen]...)
+	if scoreLen == 16 {
+		c.Score64 = binary.BigEndian.Uint64(buf[idLen:])
+		c.Secondary = binary.BigEndian.Uint64(buf[idLen+8:])
+	} else {
+		c.Score64 = uint64(binary.BigEndian.Uint32(buf[idLen:]))
+	}
+	c.Score = score32(c.Score64)
+	content, err := scsu.Decode(buf[idLen+scoreLen:])
+	if err != nil {
+		return fmt.Errorf("invalid change record #%d: %v", c.Seq, err)
+	}
+	c.Content = content
+	return nil
+}
+
+func (db *DB) logChange(bkNs *bbolt.Bucket, c Change) {
+	if !db.ChangeLog {
+		return
+	}
+	bk, _ := bkNs.CreateBucketIfNotExists(changesBucket)
+	seq, _ := bk.NextSequence()
+	bk.Put(binary.BigEndian.AppendUint64(nil, seq), c.marshal())
+}
+
+// Changes returns at most n changes whose sequence numbers are greater than since.
+func (db *DB) Changes(since uint64, n int) (res []Change, err error) {
+	tx, err := db.begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
+		return nil, nil
+	}
+	bk := bkNs.Bucket(changesBucket)
+	if bk == nil || since == math.MaxUint64 {
+		return nil, nil
+	}
+	c := bk.Cursor()
+	for k, v := c.Seek(binary.BigEndian.AppendUint64(nil, since+1)); len(k) > 0 && len(res) < n; k, v = c.Next() {
+		var ch Change
+		if err := ch.unmarshal(k, v); err != nil {
+			return res, err
+		}
+		res = append(res, ch)
+	}
+	return res, nil
+}
+
+// TruncateChanges removes all changes whose sequence numbers are not greater than seq.
+func (db *DB) TruncateChanges(seq uint64) error {
+	tx, err := db.begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
+		return nil
+	}
+	bk := bkNs.Bucket(changesBucket)
+	if bk == nil {
+		return nil
+	}
+	var keys [][]byte
+	c := bk.Cursor()
+	for k, _ := c.First(); len(k) == 8 && binary.BigEndian.Uint64(k) <= seq; k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		bk.Delete(k)
+	}
+	return tx.Commit()
+}
+
+// Apply replays changes read from another DB's change log in one transaction. Contents
+// missing from index changes are read from db.ContentProvider. Changes which fail are
+// skipped, their errors are joined and returned after the rest commit.
+func (db *DB) Apply(changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	tx, err := db.begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bkNs, err := db.createNamespace(tx, db.Namespace)
+	if err != nil {
+		return err
+	}
+	cfg, err := db.checkConfig(bkNs)
+	if err != nil {
+		return err
+	}
+	shadow, bkShadow := db.shadowTx(tx)
+
+	var errs []error
+	for _, c := range changes {
+		var err error
+		switch c.Action {
+		case "index", "rescore":
+			if c.Action == "index" && c.Content == "" && db.ContentProvider != nil {
+				if c.Content, err = db.ContentProvider.Content(c.ID); err != nil {
+					errs = append(errs, fmt.Errorf("apply %v: content: %v", c, err))
+					continue
+				}
+			}
+			doc := IndexDocument{ID: c.ID, Score64: c.score(), Secondary: c.Secondary, Content: c.Content, Rescore: c.Action == "rescore"}
+			if _, err = db.indexTx(bkNs, cfg, doc, false); err == nil && shadow != nil {
+				shadow.indexTx(bkShadow, shadow.config(), doc, false)
+			}
+		case "delete", "evict":
+			if bk, _ := deleteTx(bkNs, cfg.keyLayout(), c.ID, "delete", 0, 0); bk != nil {
+				db.logChange(bkNs, Change{Action: c.Action, ID: c.ID})
+			}
+			if bkShadow != nil {
+				deleteTx(bkShadow, shadow.config().keyLayout(), c.ID, "delete", 0, 0)
+			}
+		default:
+			err = fmt.Errorf("unknown action %q", c.Action)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("apply %v: %v", c, err))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,260 @@
+package like
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/coyove/bbolt"
+	"github.com/coyove/like/array16"
+)
+
+// Check verifies that the ID, index, content and rune buckets of the namespace agree
+// with each other, and that bucket sequences match what they count. It returns a
+// description of every inconsistency found, inconsistencies can be fixed by Repair.
+func (db *DB) Check() (problems []string, err error) {
+	tx, err := db.begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
+		return nil, nil
+	}
+	if _, err := db.checkConfig(bkNs); err != nil {
+		return nil, err
+	}
+
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	bkId, bkIndex, bkContent := bkNs.Bucket(idBucket), bkNs.Bucket(indexBucket), bkNs.Bucket(contentBucket)
+
+	l := namespaceKeyLayout(bkNs)
+	scores := map[uint64][]byte{} // index => score and secondary key
+	df := map[uint32]int{}
+	var total int
+	bkId.ForEach(func(id, payload []byte) error {
+		index, score, secondary, rest := l.payloadHeader(payload)
+		if rest == nil {
+			report("document %x: invalid payload", id)
+			return nil
+		}
+		total++
+		if index >= bkId.Sequence() {
+			report("document %x: index %d is beyond watermark %d", id, index, bkId.Sequence())
+		}
+		if _, ok := scores[index]; ok {
+			report("document %x: index %d is used by another document", id, index)
+		}
+		scores[index] = l.appendScore(nil, score, secondary)
+		if v := bkIndex.Get(AppendSortedUvarint(nil, index)); !bytes.Equal(v, id) {
+			report("document %x: index %d points to %x", id, index, v)
+		}
+		if data := bkContent.Get(id); data == nil && !db.IndexOnly {
+			report("document %x: missing content", id)
+		} else if _, err := db.decodeContent(data); data != nil && err != nil {
+			report("document %x: invalid content", id)
+		}
+
+		key := l.postingKey(score, secondary, index)
+		if !decodable(func() {
+			foreachPayload(false, rest, func(r uint32) {
+				df[r]++
+				if !hasKey(bkNs.Bucket(runeBucket(r)), key) {
+					report("document %x: missing posting in rune %x", id, r)
+				}
+			})
+		}) {
+			report("document %x: invalid payload", id)
+		}
+		return nil
+	})
+
+	var indexes int
+	bkIndex.ForEach(func(k, id []byte) error {
+		indexes++
+		if index, _, _, _ := l.payloadHeader(bkId.Get(id)); bkId.Get(id) == nil || !bytes.Equal(AppendSortedUvarint(nil, index), k) {
+			report("index %x: orphaned entry of document %x", k, id)
+		}
+		return nil
+	})
+	if seq := bkIndex.Sequence(); seq != uint64(total) || indexes != total {
+		report("total counter is %d, %d index entries, %d documents", seq, indexes, total)
+	}
+
+	bkContent.ForEach(func(id, _ []byte) error {
+		if bkId.Get(id) == nil {
+			report("content %x: orphaned", id)
+		}
+		return nil
+	})
+
+	bkNs.ForEachBucket(func(name []byte) error {
+		if len(name) != 4 || name[0] != 0 {
+			return nil
+		}
+		r := binary.BigEndian.Uint32(name)
+		bk := bkNs.Bucket(name)
+		var postings int
+		bk.ForEach(func(k, v []byte) error {
+			postings++
+			if len(k) <= l.prefixLen() {
+				report("rune %x: invalid posting %x", r, k)
+				return nil
+			}
+			index, _ := SortedUvarint(k[l.prefixLen():])
+			if score, ok := scores[index]; !ok {
+				report("rune %x: orphaned posting of index %d", r, index)
+			} else if !bytes.Equal(score, k[:l.prefixLen()]) {
+				report("rune %x: posting of index %d has score %x, document has %x", r, index, k[:l.prefixLen()], score)
+			}
+			if r == 0 && len(v) > 0 || r != 0 && !decodable(func() { array16.Foreach(v, func(uint16) bool { return true }) }) {
+				report("rune %x: undecodable positions of index %d", r, index)
+			}
+			return nil
+		})
+		if postings != df[r] {
+			report("rune %x: %d postings, %d expected", r, postings, df[r])
+		}
+		if seq := bk.Sequence(); seq != uint64(postings) {
+			report("rune %x: doc frequency counter is %d, %d postings", r, seq, postings)
+		}
+		return nil
+	})
+	return problems, nil
+}
+
+// Repair rebuilds index entries, postings and counters of the namespace from the ID
+// bucket and stored contents in a single transaction. Documents keep their indexes
+// and scores, those whose stored content is missing or undecodable are removed. An
+// error of DB.ContentProvider aborts the repair.
+func (db *DB) Repair() error {
+	tx, err := db.begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
+		return nil
+	}
+	cfg, err := db.checkConfig(bkNs)
+	if err != nil {
+		return err
+	}
+	if db.IndexOnly && db.ContentProvider == nil {
+		return fmt.Errorf("index-only namespace can't be repaired without a ContentProvider")
+	}
+	l := cfg.keyLayout()
+
+	var derived [][]byte
+	bkNs.ForEachBucket(func(name []byte) error {
+		if len(name) == 4 && name[0] == 0 {
+			derived = append(derived, append([]byte(nil), name...))
+		}
+		return nil
+	})
+	for _, name := range append(derived, indexBucket) {
+		if err := bkNs.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	bkIndex, err := bkNs.CreateBucket(indexBucket)
+	if err != nil {
+		return err
+	}
+	bkId, bkContent := bkNs.Bucket(idBucket), bkNs.Bucket(contentBucket)
+
+	var ids, orphans [][]byte
+	bkId.ForEach(func(id, _ []byte) error {
+		ids = append(ids, append([]byte(nil), id...))
+		return nil
+	})
+	bkContent.ForEach(func(id, _ []byte) error {
+		if bkId.Get(id) == nil {
+			orphans = append(orphans, append([]byte(nil), id...))
+		}
+		return nil
+	})
+	for _, id := range orphans {
+		bkContent.Delete(id)
+	}
+
+	watermark := bkId.Sequence()
+	used := map[uint64]bool{}
+	var total uint64
+	for _, id := range ids {
+		index, score, secondary, rest := l.payloadHeader(bkId.Get(id))
+		var content string
+		if data := bkContent.Get(id); data != nil {
+			content, err = db.decodeContent(data)
+		} else if db.ContentProvider != nil {
+			if content, err = db.ContentProvider.Content(id); err != nil {
+				return fmt.Errorf("document %x: content: %v", id, err)
+			}
+		} else {
+			err = errContentNotStored
+		}
+		chars, _ := Collect(content, cfg.MaxChars)
+		if err != nil || len(chars) == 0 {
+			bkId.Delete(id)
+			bkContent.Delete(id)
+			continue
+		}
+		if rest == nil || used[index] || index >= watermark {
+			index = watermark
+			watermark++
+		}
+		used[index] = true
+
+		chars[0] = nil
+		key := l.postingKey(score, secondary, index)
+		for r, v := range chars {
+			bk, err := bkNs.CreateBucketIfNotExists(runeBucket(uint32(r)))
+			if err != nil {
+				return err
+			}
+			bk.SetSequence(bk.Sequence() + 1)
+			if err := bk.Put(key, v); err != nil {
+				return err
+			}
+		}
+		payload, err := l.encodePayload(index, score, secondary, chars)
+		if err != nil {
+			return fmt.Errorf("document %x: %v", id, err)
+		}
+		if err := bkId.Put(id, payload); err != nil {
+			return err
+		}
+		if err := bkIndex.Put(key[l.prefixLen():], id); err != nil {
+			return err
+		}
+		total++
+	}
+	bkId.SetSequence(watermark)
+	bkIndex.SetSequence(total)
+	return tx.Commit()
+}
+
+func hasKey(bk *bbolt.Bucket, key []byte) bool {
+	if bk == nil {
+		return false
+	}
+	k, _ := bk.Cursor().Seek(key)
+	return bytes.Equal(k, key)
+}
+
+// decodable reports whether f, which decodes stored data, finishes without panicking.
+func decodable(f func()) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	f()
+	return true
+}
@@ -0,0 +1,242 @@
+package like
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coyove/bbolt"
+)
+
+type CompactOptions struct {
+	// Namespaces to copy, all namespaces if empty.
+	Namespaces []string
+	// Renumber assigns document indexes densely from 0, preserving their order.
+	Renumber bool
+	// TxSize is the number of puts per write transaction, 100000 if zero.
+	TxSize int
+}
+
+// CompactTo writes namespaces of db into a new store at path. Every bucket is written
+// once in key order, append-mostly buckets (index, changes) are filled completely and
+// others are left with some room for random inserts. It returns file sizes before and
+// after compaction. The source is read in one transaction, db keeps using its own file,
+// callers may replace the file and Reopen afterwards.
+func (db *DB) CompactTo(path string, opts CompactOptions) (before, after int64, err error) {
+	if _, err := os.Stat(path); err == nil {
+		return 0, 0, fmt.Errorf("%s already exists", path)
+	}
+	if opts.TxSize <= 0 {
+		opts.TxSize = bulkTxPuts
+	}
+
+	tx, err := db.begin(false)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	before = tx.Size()
+
+	names := opts.Namespaces
+	if len(names) == 0 {
+		if nss := namespaces(tx); nss != nil {
+			nss.ForEachBucket(func(k []byte) error {
+				names = append(names, string(k))
+				return nil
+			})
+		}
+		if root := tx.Bucket(rootBucket); root != nil && root.Bucket(aliasesBucket) != nil {
+			root.Bucket(aliasesBucket).ForEach(func(k, _ []byte) error {
+				names = append(names, string(k))
+				return nil
+			})
+		}
+	}
+
+	store, err := bbolt.Open(path, 0644, &bbolt.Options{FreelistType: bbolt.FreelistMapType, NoSync: true})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err2 := store.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			os.Remove(path)
+			return
+		}
+		if fi, err2 := os.Stat(path); err2 == nil {
+			after = fi.Size()
+		}
+	}()
+
+	w := &compactWriter{begin: func() (*bbolt.Tx, error) { return store.Begin(true) }, txSize: opts.TxSize}
+	if w.tx, err = w.begin(); err != nil {
+		return 0, 0, err
+	}
+	defer func() { w.tx.Rollback() }()
+	if _, err := createRoot(w.tx); err != nil {
+		return 0, 0, err
+	}
+
+	done := map[string]bool{}
+	for _, name := range names {
+		physical := string(resolveNamespace(tx, name))
+		bkNs := getNamespace(tx, name)
+		if bkNs == nil {
+			return 0, 0, fmt.Errorf("namespace %q not found", name)
+		}
+		if physical != name {
+			if err := w.put([][]byte{rootBucket, aliasesBucket}, []byte(name), []byte(physical)); err != nil {
+				return 0, 0, err
+			}
+		}
+		if done[physical] {
+			continue
+		}
+		done[physical] = true
+		if err := w.namespace(bkNs, physical, opts.Renumber); err != nil {
+			return 0, 0, fmt.Errorf("namespace %q: %v", physical, err)
+		}
+	}
+	if err := w.tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return before, after, store.Sync()
+}
+
+// compactWriter puts keys into nested buckets, committing every txSize puts.
+type compactWriter struct {
+	begin  func() (*bbolt.Tx, error)
+	tx     *bbolt.Tx
+	txSize int
+	puts   int
+	path   [][]byte
+	bk     *bbolt.Bucket
+}
+
+// bucket returns the bucket at path in the current transaction, creating it if needed.
+func (w *compactWriter) bucket(path [][]byte) (*bbolt.Bucket, error) {
+	if w.bk != nil && len(path) == len(w.path) {
+		same := true
+		for i := range path {
+			same = same && string(path[i]) == string(w.path[i])
+		}
+		if same {
+			return w.bk, nil
+		}
+	}
+	bk, err := w.tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			return nil, err
+		}
+		bk, err = bk.CreateBucketIfNotExists(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	bk.FillPercent = 0.9
+	if last := path[len(path)-1]; string(last) == string(indexBucket) || string(last) == string(changesBucket) {
+		bk.FillPercent = 1
+	}
+	w.path, w.bk = append(w.path[:0], path...), bk
+	return bk, nil
+}
+
+func (w *compactWriter) put(path [][]byte, k, v []byte) error {
+	bk, err := w.bucket(path)
+	if err != nil {
+		return err
+	}
+	if err := bk.Put(k, v); err != nil {
+		return err
+	}
+	if w.puts++; w.puts%w.txSize == 0 {
+		if err := w.tx.Commit(); err != nil {
+			return err
+		}
+		w.bk = nil
+		w.tx, err = w.begin()
+		return err
+	}
+	return nil
+}
+
+func (w *compactWriter) setSequence(path [][]byte, seq uint64) error {
+	bk, err := w.bucket(path)
+	if err != nil {
+		return err
+	}
+	return bk.SetSequence(seq)
+}
+
+func (w *compactWriter) namespace(bkNs *bbolt.Bucket, name string, renumber bool) error {
+	var indexes map[uint64]uint64
+	if renumber {
+		indexes = map[uint64]uint64{}
+		bkNs.Bucket(indexBucket).ForEach(func(k, _ []byte) error {
+			index, _ := SortedUvarint(k)
+			indexes[index] = uint64(len(indexes))
+			return nil
+		})
+	}
+	renumberKey := func(prefix, k []byte) ([]byte, bool) {
+		index, _ := SortedUvarint(k[len(prefix):])
+		n, ok := indexes[index]
+		return AppendSortedUvarint(append([]byte(nil), prefix...), n), ok
+	}
+
+	prefixLen := namespaceKeyLayout(bkNs).prefixLen()
+	base := [][]byte{rootBucket, namespacesBucket, []byte(name)}
+	if _, err := w.bucket(base); err != nil {
+		return err
+	}
+	return bkNs.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return w.put(base, k, v)
+		}
+		path := append(base[:len(base):len(base)], k)
+		src := bkNs.Bucket(k)
+		seq := src.Sequence()
+		if renumber && string(k) == string(idBucket) {
+			seq = uint64(len(indexes))
+		}
+		if err := w.setSequence(path, seq); err != nil {
+			return err
+		}
+
+		var rewrite func(k, v []byte) ([]byte, []byte, bool)
+		switch {
+		case !renumber:
+		case string(k) == string(idBucket):
+			rewrite = func(k, v []byte) ([]byte, []byte, bool) {
+				_, n := SortedUvarint(v)
+				key, ok := renumberKey(nil, v[:n])
+				return k, append(key, v[n:]...), ok
+			}
+		case string(k) == string(indexBucket):
+			rewrite = func(k, v []byte) ([]byte, []byte, bool) {
+				key, ok := renumberKey(nil, k)
+				return key, v, ok
+			}
+		case len(k) == 4 && k[0] == 0:
+			rewrite = func(k, v []byte) ([]byte, []byte, bool) {
+				key, ok := renumberKey(k[:prefixLen], k)
+				return key, v, ok
+			}
+		}
+
+		return src.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return fmt.Errorf("unexpected nested bucket %q", k)
+			}
+			if rewrite != nil {
+				var ok bool
+				if k, v, ok = rewrite(k, v); !ok {
+					return nil // dangling entry
+				}
+			}
+			return w.put(path, k, v)
+		})
+	})
+}
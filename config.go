@@ -0,0 +1,245 @@
+package like
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/coyove/bbolt"
+)
+
+// Identifiers of the tokenization rules in CollectFunc and of hashTrigram,
+// change them whenever either produces different chars for the same input.
+const (
+	tokenizerName   = "collect-v1"
+	trigramHashName = "crc32-ieee-f0"
+)
+
+var (
+	ErrConfigMismatch = errors.New("index configuration mismatch")
+	ErrUnfinishedLoad = errors.New("unfinished bulk load")
+)
+
+type nsConfig struct {
+	Version     int    `json:"version"`
+	MaxChars    uint16 `json:"max_chars"`
+	Tokenizer   string `json:"tokenizer"`
+	TrigramHash string `json:"trigram_hash,omitempty"`
+	// Widths of scores and secondary keys in bits, see DB.ScoreBits.
+	ScoreBits     int `json:"score_bits,omitempty"`
+	SecondaryBits int `json:"secondary_bits,omitempty"`
+	// Loading is set while BulkLoader writes the namespace.
+	Loading bool `json:"loading,omitempty"`
+}
+
+func (c nsConfig) marshal() []byte {
+	buf, _ := json.Marshal(c)
+	return buf
+}
+
+func (c nsConfig) String() string {
+	return fmt.Sprintf("max_chars=%d tokenizer=%s trigram_hash=%s score_bits=%d secondary_bits=%d",
+		c.MaxChars, c.Tokenizer, c.TrigramHash, c.ScoreBits, c.SecondaryBits)
+}
+
+func (c nsConfig) keyLayout() keyLayout {
+	return keyLayout{scoreLen: c.ScoreBits / 8, secondaryLen: c.SecondaryBits / 8}
+}
+
+func (db *DB) config() nsConfig {
+	db.cfgMu.RLock()
+	defer db.cfgMu.RUnlock()
+	c := nsConfig{
+		Version:       formatVersion,
+		MaxChars:      db.MaxChars,
+		Tokenizer:     tokenizerName,
+		TrigramHash:   trigramHashName,
+		ScoreBits:     db.ScoreBits,
+		SecondaryBits: db.SecondaryBits,
+	}
+	if c.ScoreBits == 0 {
+		c.ScoreBits = 32
+	}
+	return c
+}
+
+func checkKeyBits(scoreBits, secondaryBits int) error {
+	if scoreBits != 0 && scoreBits != 32 && scoreBits != 64 {
+		return fmt.Errorf("invalid score bits %d, must be 32 or 64", scoreBits)
+	}
+	if secondaryBits != 0 && secondaryBits != 32 && secondaryBits != 64 {
+		return fmt.Errorf("invalid secondary key bits %d, must be 0, 32 or 64", secondaryBits)
+	}
+	return nil
+}
+
+func readConfig(bkNs *bbolt.Bucket) (c nsConfig, err error) {
+	if err := json.Unmarshal(bkNs.Get(configKey), &c); err != nil {
+		return c, fmt.Errorf("invalid namespace config: %v", err)
+	}
+	if c.TrigramHash == "" {
+		// Written before the trigram hash was recorded, only one existed then.
+		c.TrigramHash = trigramHashName
+	}
+	if c.ScoreBits == 0 {
+		// Written before score width was configurable.
+		c.ScoreBits = 32
+	}
+	return c, nil
+}
+
+// namespaceKeyLayout returns the key layout recorded in the config of bkNs.
+func namespaceKeyLayout(bkNs *bbolt.Bucket) keyLayout {
+	c, err := readConfig(bkNs)
+	if err != nil {
+		return keyLayout{scoreLen: 4}
+	}
+	return c.keyLayout()
+}
+
+func (c nsConfig) matches(o nsConfig) bool {
+	return c.MaxChars == o.MaxChars &&
+		c.Tokenizer == o.Tokenizer &&
+		c.TrigramHash == o.TrigramHash &&
+		c.ScoreBits == o.ScoreBits &&
+		c.SecondaryBits == o.SecondaryBits
+}
+
+// cfgSwitch records db's settings before and after the last Reindex, whose switch is
+// committed by transaction tx.
+type cfgSwitch struct {
+	tx         int
+	prev, next nsConfig
+}
+
+// checkConfig returns the config of bkNs if it matches db's settings, the key layout
+// and MaxChars of the namespace must be taken from it. Reindex updates db's settings
+// only after its switch has committed, so transactions on either side of the switch
+// accept the settings of the namespace they see.
+func (db *DB) checkConfig(bkNs *bbolt.Bucket) (nsConfig, error) {
+	stored, err := readConfig(bkNs)
+	if err != nil {
+		return stored, err
+	}
+	if stored.Loading {
+		return stored, fmt.Errorf("%w: namespace %q is incomplete, drop it and load again", ErrUnfinishedLoad, db.Namespace)
+	}
+	current := db.config()
+	if stored.matches(current) {
+		return stored, nil
+	}
+	db.cfgMu.RLock()
+	s := db.cfgSwitch
+	db.cfgMu.RUnlock()
+	if s != nil && (bkNs.Tx().ID() < s.tx && stored.matches(s.prev) || bkNs.Tx().ID() >= s.tx && stored.matches(s.next)) {
+		return stored, nil
+	}
+	return stored, fmt.Errorf("%w: namespace %q was built with %v, current settings are %v, rebuild it with DB.Rebuild",
+		ErrConfigMismatch, db.Namespace, stored, current)
+}
+
+// CheckConfig verifies that the namespace was built with the current settings.
+func (db *DB) CheckConfig() error {
+	tx, err := db.begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if bkNs := db.namespace(tx); bkNs != nil {
+		_, err := db.checkConfig(bkNs)
+		return err
+	}
+	return nil
+}
+
+// Rebuild reindexes every document of the namespace from its stored content using
+// current settings. Documents keep their IDs, scores and relative insertion order.
+// It is Reindex into a namespace named after db.Namespace, which db.Namespace then
+// becomes an alias of. A namespace left by an interrupted Rebuild is discarded.
+func (db *DB) Rebuild(batchSize int) error {
+	tx, err := db.begin(false)
+	if err != nil {
+		return err
+	}
+	if getNamespace(tx, db.Namespace) == nil {
+		tx.Rollback()
+		return nil
+	}
+	// Rebuilds alternate between two names, the one not in use is the target.
+	to := db.Namespace + "\x00rebuild"
+	if string(resolveNamespace(tx, db.Namespace)) == to {
+		to += "2"
+	}
+	tx.Rollback()
+	return db.reindexTo(db.Namespace, to, ReindexOptions{BatchSize: batchSize}, true)
+}
+
+// copyDocuments indexes documents of namespace src into the namespace of w using w's
+// settings, in insertion order. Each transaction copies at most batchSize documents.
+func (db *DB) copyDocuments(w *DB, src string, batchSize int, progress func(int)) error {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	var after []byte
+	var total int
+	for {
+		tx, err := db.begin(true)
+		if err != nil {
+			return err
+		}
+
+		var n int
+		after, n, err = w.copyDocumentsTx(tx, src, after, batchSize)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if total += n; progress != nil {
+			progress(total)
+		}
+		if n < batchSize {
+			return nil
+		}
+	}
+}
+
+func (db *DB) copyDocumentsTx(tx *bbolt.Tx, src string, after []byte, n int) ([]byte, int, error) {
+	bkSrc := getNamespace(tx, src)
+	if bkSrc == nil {
+		return after, 0, fmt.Errorf("namespace %q not found", src)
+	}
+	bkDst, err := db.createNamespace(tx, db.Namespace)
+	if err != nil {
+		return after, 0, err
+	}
+
+	bkId, l, cfg := bkSrc.Bucket(idBucket), namespaceKeyLayout(bkSrc), db.config()
+	c := bkSrc.Bucket(indexBucket).Cursor()
+	k, id := c.First()
+	if len(after) > 0 {
+		if k, id = c.Seek(after); bytes.Equal(k, after) {
+			k, id = c.Next()
+		}
+	}
+
+	var i int
+	for ; i < n && len(k) > 0; k, id = c.Next() {
+		_, score, secondary, _ := l.payloadHeader(bkId.Get(id))
+		content, err := db.content(bkSrc, id)
+		if err != nil {
+			return after, i, fmt.Errorf("document %x: content: %v", id, err)
+		}
+		doc := IndexDocument{ID: append([]byte(nil), id...), Score64: score, Secondary: secondary, Content: content}
+		if _, err := db.indexTx(bkDst, cfg, doc, false); err != nil {
+			return after, i, fmt.Errorf("document %x: %v", id, err)
+		}
+		after = append(after[:0], k...)
+		i++
+	}
+	return after, i, nil
+}
@@ -0,0 +1,219 @@
+package like
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/coyove/bbolt"
+	"github.com/dop251/scsu"
+)
+
+var errContentNotStored = errors.New("content is not stored")
+
+// ContentProvider supplies contents of documents indexed with DB.IndexOnly.
+type ContentProvider interface {
+	Content(id []byte) (string, error)
+}
+
+// ContentCodec encodes stored contents. Every stored value starts with the ID of
+// its codec, so values written by different codecs can be mixed in one namespace.
+type ContentCodec interface {
+	// ID identifies the codec in stored values, 0-15 are reserved for built-in codecs.
+	ID() byte
+	Encode(content string) ([]byte, error)
+	Decode(data []byte) (string, error)
+}
+
+var (
+	// SCSUCodec is the default codec, it stores CJK text in about 2 bytes per char.
+	SCSUCodec ContentCodec = scsuCodec{}
+	// FlateCodec compresses contents with DEFLATE, suits long or repetitive texts.
+	FlateCodec ContentCodec = &flateCodec{id: 2, level: flate.DefaultCompression}
+)
+
+var contentCodecs sync.Map // byte => ContentCodec
+
+func init() {
+	contentCodecs.Store(SCSUCodec.ID(), SCSUCodec)
+	contentCodecs.Store(FlateCodec.ID(), FlateCodec)
+}
+
+// RegisterContentCodec makes values written by c decodable by every DB, codecs set
+// as DB.ContentCodec don't need to be registered. It panics if the ID of c is reserved
+// or already registered.
+func RegisterContentCodec(c ContentCodec) {
+	if c.ID() < 16 {
+		panic(fmt.Sprintf("content codec ID %d is reserved", c.ID()))
+	}
+	if _, loaded := contentCodecs.LoadOrStore(c.ID(), c); loaded {
+		panic(fmt.Sprintf("content codec ID %d is already registered", c.ID()))
+	}
+}
+
+// contentCodec returns db.ContentCodec, which may only use a reserved ID if it is the
+// built-in codec of that ID.
+func (db *DB) contentCodec() (ContentCodec, error) {
+	c := db.ContentCodec
+	if c == nil {
+		return SCSUCodec, nil
+	}
+	if c.ID() < 16 {
+		if b, ok := contentCodecs.Load(c.ID()); !ok || b != c {
+			return nil, fmt.Errorf("content codec ID %d is reserved", c.ID())
+		}
+	}
+	return c, nil
+}
+
+func (db *DB) encodeContent(content string) ([]byte, error) {
+	c, err := db.contentCodec()
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.Encode(content)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{c.ID()}, data...), nil
+}
+
+func (db *DB) decodeContent(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", fmt.Errorf("empty content")
+	}
+	if c := db.ContentCodec; c != nil && c.ID() >= 16 && c.ID() == data[0] {
+		return c.Decode(data[1:])
+	}
+	if c, ok := contentCodecs.Load(data[0]); ok {
+		return c.(ContentCodec).Decode(data[1:])
+	}
+	return "", fmt.Errorf("unknown content codec %d", data[0])
+}
+
+// content returns the content of document id in namespace bkNs, falling back to
+// db.ContentProvider if it is not stored.
+func (db *DB) content(bkNs *bbolt.Bucket, id []byte) (string, error) {
+	if data := bkNs.Bucket(contentBucket).Get(id); data != nil {
+		return db.decodeContent(data)
+	}
+	if db.ContentProvider != nil {
+		return db.ContentProvider.Content(id)
+	}
+	return "", errContentNotStored
+}
+
+type scsuCodec struct{}
+
+func (scsuCodec) ID() byte { return 1 }
+
+func (scsuCodec) Encode(content string) ([]byte, error) { return scsu.Encode(content, nil) }
+
+func (scsuCodec) Decode(data []byte) (string, error) { return scsu.Decode(data) }
+
+type flateCodec struct {
+	id      byte
+	level   int
+	dict    []byte
+	writers sync.Pool
+}
+
+// NewDictCodec returns a DEFLATE codec using dict as preset dictionary, which helps
+// short contents sharing common words, see TrainDict. The same dictionary must be
+// used to decode, so once values are written under an ID, its dictionary can't change.
+// It panics if id is reserved.
+func NewDictCodec(id byte, dict []byte) ContentCodec {
+	if id < 16 {
+		panic(fmt.Sprintf("content codec ID %d is reserved", id))
+	}
+	// Lower levels don't find matches in the dictionary for short inputs.
+	return &flateCodec{id: id, level: flate.BestCompression, dict: dict}
+}
+
+func (c *flateCodec) ID() byte { return c.id }
+
+func (c *flateCodec) Encode(content string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriterDict(buf, c.level, c.dict); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := io.WriteString(w, content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCodec) Decode(data []byte) (string, error) {
+	r := flate.NewReaderDict(bytes.NewReader(data), c.dict)
+	defer r.Close()
+	buf := &strings.Builder{}
+	_, err := io.Copy(buf, r)
+	return buf.String(), err
+}
+
+// TrainDict builds a preset dictionary of at most size bytes for NewDictCodec from
+// sample contents, made of their most frequent words and word pairs. DEFLATE only
+// looks back 32KB, so larger sizes are truncated.
+func TrainDict(samples []string, size int) []byte {
+	if size > 32<<10 || size <= 0 {
+		size = 32 << 10
+	}
+
+	counts := map[string]int{}
+	for _, s := range samples {
+		words := strings.Fields(s)
+		for i, w := range words {
+			counts[w+" "]++
+			if i > 0 {
+				counts[words[i-1]+" "+w+" "]++
+			}
+		}
+	}
+
+	type gram struct {
+		s     string
+		score int
+	}
+	var grams []gram
+	for s, n := range counts {
+		if n > 1 && len(s) > 3 {
+			grams = append(grams, gram{s, n * len(s)})
+		}
+	}
+	sort.Slice(grams, func(i, j int) bool {
+		if grams[i].score != grams[j].score {
+			return grams[i].score > grams[j].score
+		}
+		return grams[i].s < grams[j].s
+	})
+
+	// Most useful grams go last, closer matches are cheaper to encode.
+	var picked []string
+	for _, g := range grams {
+		if size -= len(g.s); size < 0 {
+			break
+		}
+		picked = append(picked, g.s)
+	}
+	var dict []byte
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+	return dict
+}
@@ -0,0 +1,138 @@
+package like
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+
+	"github.com/coyove/bbolt"
+)
+
+var (
+	ErrInvalidCursor  = errors.New("invalid search cursor")
+	ErrCursorMismatch = errors.New("search cursor belongs to another query")
+)
+
+const cursorVersion = 2
+
+// SearchCursor is an opaque position of a paged search, see SearchPage.
+type SearchCursor struct {
+	hash     uint64
+	backward bool
+	key      []byte
+}
+
+// Marshal encodes c into a URL-safe string.
+func (c *SearchCursor) Marshal() string {
+	buf := []byte{cursorVersion, 0}
+	if c.backward {
+		buf[1] = 1
+	}
+	buf = binary.BigEndian.AppendUint64(buf, c.hash)
+	return base64.RawURLEncoding.EncodeToString(append(buf, c.key...))
+}
+
+func UnmarshalSearchCursor(s string) (*SearchCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) < 10+5 || buf[0] != cursorVersion || buf[1] > 1 {
+		return nil, ErrInvalidCursor
+	}
+	return &SearchCursor{
+		hash:     binary.BigEndian.Uint64(buf[2:]),
+		backward: buf[1] == 1,
+		key:      buf[10:],
+	}, nil
+}
+
+// searchHash identifies a query and the search options which affect its results, as
+// well as the namespace seen by tx and its config, which change after Reindex.
+func (db *DB) searchHash(tx *bbolt.Tx, query string, metrics *Metrics) uint64 {
+	if metrics == nil {
+		metrics = &Metrics{}
+	}
+	var cfg string
+	if bkNs := getNamespace(tx, db.Namespace); bkNs != nil {
+		if c, err := readConfig(bkNs); err == nil {
+			cfg = c.String()
+		}
+	}
+	h := fnv.New64a()
+	var buf []byte
+	for _, b := range [][]byte{resolveNamespace(tx, db.Namespace), []byte(cfg), []byte(query),
+		metrics.IDPrefix, metrics.IDRange[0], metrics.IDRange[1]} {
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		buf = append(buf, b...)
+	}
+	lo, hi := metrics.scoreRange()
+	buf = binary.BigEndian.AppendUint64(buf, lo)
+	buf = binary.BigEndian.AppendUint64(buf, hi)
+	if metrics.Ascending {
+		buf = append(buf, 1)
+	}
+	h.Write(buf)
+	return h.Sum64()
+}
+
+// SearchPage is like Search but pages with cursors, which can go back to the previous
+// page as well. cursor is nil for the first page, prev or next is nil if there are no
+// more results in that direction. Cursors are only valid for the same query and options.
+func (db *DB) SearchPage(query string, cursor *SearchCursor, n int, metrics *Metrics) (res []Document, prev, next *SearchCursor, err error) {
+	tx, err := db.begin(false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback()
+	return db.searchPage(db.searchHash(tx, query, metrics), func(query string, start []byte, n int, metrics *Metrics) ([]Document, []byte) {
+		return db.search(tx, query, start, n, metrics)
+	}, query, cursor, n, metrics)
+}
+
+func (db *DB) searchPage(hash uint64, search func(string, []byte, int, *Metrics) ([]Document, []byte),
+	query string, cursor *SearchCursor, n int, metrics *Metrics) (res []Document, prev, next *SearchCursor, err error) {
+	if metrics == nil {
+		metrics = &Metrics{}
+	}
+	if cursor != nil && cursor.hash != hash {
+		return nil, nil, nil, ErrCursorMismatch
+	}
+
+	if cursor == nil || !cursor.backward {
+		var start, nextKey []byte
+		if cursor != nil {
+			start = cursor.key
+		}
+		res, nextKey = search(query, start, n, metrics)
+		if len(nextKey) > 0 {
+			next = &SearchCursor{hash: hash, key: nextKey}
+		}
+		if cursor != nil && len(res) > 0 {
+			prev = &SearchCursor{hash: hash, backward: true, key: res[0].key}
+		}
+		return res, prev, next, nil
+	}
+
+	// Walk backwards from the first result of the page after, excluding it. The walk
+	// uses a copy of metrics, so the caller's options stay intact even if search panics.
+	m := *metrics
+	m.Ascending = !m.Ascending
+	res, nextKey := search(query, cursor.key, n+1, &m)
+	m.Ascending = metrics.Ascending
+	*metrics = m
+	if len(res) > 0 && bytes.Equal(res[0].key, cursor.key) {
+		res = res[1:]
+	}
+	more := len(res) > n || len(nextKey) > 0
+	if len(res) > n {
+		res = res[:n]
+	}
+	if more && len(res) > 0 {
+		prev = &SearchCursor{hash: hash, backward: true, key: res[len(res)-1].key}
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	next = &SearchCursor{hash: hash, key: cursor.key}
+	return res, prev, next, nil
+}
@@ -2,7 +2,9 @@ package like
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 	"unicode"
 	"unsafe"
@@ -12,37 +14,306 @@ import (
 
 var shortDocString bool
 
+var ErrReadOnly = errors.New("database is opened read-only")
+
 type DB struct {
 	Store         *bbolt.DB
 	Namespace     string
 	MaxChars      uint16
 	OnEvict       func([]byte)
+	OnPercolate   func(IndexDocument, []string)
 	SearchTimeout time.Duration
 	FreelistRange [2]int
+	ChangeLog     bool
+	// IndexOnly skips storing contents, ContentProvider supplies them when needed.
+	IndexOnly       bool
+	ContentProvider ContentProvider
+	// ContentCodec encodes stored contents, SCSUCodec if nil.
+	ContentCodec ContentCodec
+	// ScoreBits is the width of scores, 32 (default) or 64. SecondaryBits is the width
+	// of secondary keys, which order documents of equal scores, 0 (default, disabled),
+	// 32 or 64. Both are fixed when a namespace is created, see Rebuild and Reindex.
+	ScoreBits     int
+	SecondaryBits int
 
-	maxDocsTest uint64
-	cfls        int
+	maxDocsTest         uint64
+	maxIDCandidatesTest int
+	cfls                int
+	mu                  sync.Mutex
+	percolator          *percolator
+	storeMu             sync.RWMutex
+	storeOpts           *bbolt.Options
+	closing             chan struct{}
+	bg                  sync.WaitGroup
+	indexers            []*Indexer
+	snapshots           map[*Snapshot]bool
+	groupSync           bool
+	durable             uint64        // ID of the last transaction known to be on disk
+	synced              chan struct{} // closed and replaced after every sync attempt
+	syncErr             error
+	reindex             *reindexState
+	cfgMu               sync.RWMutex
+	cfgSwitch           *cfgSwitch
+}
+
+type Durability int
+
+const (
+	// NoSync never fsyncs, a crash may lose recently committed documents.
+	NoSync Durability = iota
+	// SyncEveryCommit fsyncs before every write transaction returns.
+	SyncEveryCommit
+	// GroupCommit fsyncs in background every Options.GroupCommitInterval.
+	GroupCommit
+)
+
+type Options struct {
+	Durability          Durability
+	GroupCommitInterval time.Duration
+	ReadOnly            bool
+	Migrate             bool
 }
 
 func (db *DB) OpenDefault(path string) (err error) {
-	db.Store, err = bbolt.Open(path, 0644, &bbolt.Options{
-		FreelistType: bbolt.FreelistMapType,
-		NoSync:       true,
-	})
 	db.MaxChars = 65535
-	return
+	return db.Open(path, Options{Durability: NoSync})
 }
 
-type Document struct {
-	Index uint64
-	Segs  [][2]uint16
-	ID    []byte
-	Score uint32
-	db    *DB
+func (db *DB) OpenReadOnly(path string) (err error) {
+	return db.Open(path, Options{ReadOnly: true})
+}
+
+func (db *DB) Open(path string, opts Options) (err error) {
+	if err := checkKeyBits(db.ScoreBits, db.SecondaryBits); err != nil {
+		return err
+	}
+	if _, err := db.contentCodec(); err != nil {
+		return err
+	}
+	storeOpts := &bbolt.Options{
+		FreelistType: bbolt.FreelistMapType,
+		NoSync:       opts.Durability != SyncEveryCommit,
+		ReadOnly:     opts.ReadOnly,
+	}
+	db.Store, err = bbolt.Open(path, 0644, storeOpts)
+	if err != nil {
+		return err
+	}
+	db.storeOpts = storeOpts
+	if db.MaxChars == 0 {
+		db.MaxChars = 65535
+	}
+
+	err = db.Store.View(checkLayout)
+	if err == ErrLegacyLayout && opts.Migrate && !opts.ReadOnly {
+		err = db.migrate()
+	} else if err == nil && !opts.ReadOnly {
+		err = db.Store.Update(func(tx *bbolt.Tx) error {
+			_, err := createRoot(tx)
+			return err
+		})
+	}
+	if err != nil {
+		db.Store.Close()
+		return err
+	}
+
+	db.closing = make(chan struct{})
+	db.synced = make(chan struct{})
+	db.groupSync = opts.Durability == GroupCommit && !opts.ReadOnly
+	if db.groupSync {
+		interval := opts.GroupCommitInterval
+		if interval <= 0 {
+			interval = 100 * time.Millisecond
+		}
+		db.bg.Add(1)
+		go db.groupCommit(interval, db.closing)
+	}
+	return nil
+}
+
+func (db *DB) groupCommit(interval time.Duration, closing chan struct{}) {
+	defer db.bg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			db.Sync()
+		case <-closing:
+			return
+		}
+	}
+}
+
+// Sync flushes all committed transactions to disk, after which they survive a crash.
+func (db *DB) Sync() error {
+	if db.ReadOnly() {
+		return nil
+	}
+	db.storeMu.RLock()
+	defer db.storeMu.RUnlock()
+	id, err := lastTxID(db.Store)
+	if err == nil {
+		err = db.Store.Sync()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err == nil && id > db.durable {
+		db.durable = id
+	}
+	db.syncErr = err
+	if db.synced != nil {
+		close(db.synced)
+		db.synced = make(chan struct{})
+	}
+	return err
+}
+
+// WaitDurable blocks until every transaction committed before the call is on disk,
+// e.g. before acknowledging writes. With GroupCommit it waits for the next background
+// sync, otherwise it syncs itself unless every commit is synced already. A DB not
+// opened by Open doesn't know how its store syncs, so it always syncs.
+func (db *DB) WaitDurable() error {
+	if db.ReadOnly() || db.storeOpts != nil && !db.storeOpts.NoSync {
+		return nil
+	}
+	if !db.groupSync {
+		return db.Sync()
+	}
+	db.storeMu.RLock()
+	id, err := lastTxID(db.Store)
+	db.storeMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for waited := false; ; waited = true {
+		db.mu.Lock()
+		durable, synced, err := db.durable, db.synced, db.syncErr
+		db.mu.Unlock()
+		if durable >= id {
+			return nil
+		}
+		if waited && err != nil {
+			return err
+		}
+		<-synced
+	}
+}
+
+// lastTxID returns the ID of the last committed write transaction of store.
+func lastTxID(store *bbolt.DB) (uint64, error) {
+	tx, err := store.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return uint64(tx.ID()), nil
+}
+
+// Close stops background goroutines, flushes pending writes and closes the store.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	indexers := append([]*Indexer(nil), db.indexers...)
+	db.mu.Unlock()
+	for _, ix := range indexers {
+		ix.Close()
+	}
+	db.closeSnapshots()
+
+	db.mu.Lock()
+	if db.closing != nil {
+		close(db.closing)
+		db.closing = nil
+	}
+	db.mu.Unlock()
+	db.bg.Wait()
+
+	err := db.Sync()
+	db.storeMu.Lock()
+	defer db.storeMu.Unlock()
+	if err2 := db.Store.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Reopen closes and opens the underlying file again, picking up a replaced
+// index file. In read-only mode transactions in flight finish on the old file.
+// Snapshots are closed.
+func (db *DB) Reopen() error {
+	db.closeSnapshots()
+	if !db.ReadOnly() {
+		db.storeMu.Lock()
+		defer db.storeMu.Unlock()
+		path := db.Store.Path()
+		if err := db.Store.Close(); err != nil {
+			return err
+		}
+		store, err := openStore(path, db.storeOpts)
+		if err != nil {
+			return err
+		}
+		db.Store = store
+		return nil
+	}
+
+	db.storeMu.RLock()
+	old := db.Store
+	db.storeMu.RUnlock()
+
+	store, err := openStore(old.Path(), db.storeOpts)
+	if err != nil {
+		return err
+	}
+
+	db.storeMu.Lock()
+	db.Store = store
+	db.storeMu.Unlock()
+	return old.Close()
+}
+
+func openStore(path string, opts *bbolt.Options) (*bbolt.DB, error) {
+	store, err := bbolt.Open(path, 0644, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.View(checkLayout); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (db *DB) maxChars() uint16 {
+	db.cfgMu.RLock()
+	defer db.cfgMu.RUnlock()
+	return db.MaxChars
+}
+
+func (db *DB) ReadOnly() bool {
+	return db.storeOpts != nil && db.storeOpts.ReadOnly
 }
 
-func (d Document) boundKey(in []byte) []byte {
-	return AppendSortedUvarint(binary.BigEndian.AppendUint32(in, d.Score), d.Index)
+func (db *DB) begin(writable bool) (*bbolt.Tx, error) {
+	if writable && db.ReadOnly() {
+		return nil, ErrReadOnly
+	}
+	db.storeMu.RLock()
+	defer db.storeMu.RUnlock()
+	return db.Store.Begin(writable)
+}
+
+type Document struct {
+	Index     uint64
+	Segs      [][2]uint16
+	ID        []byte
+	Score     uint32 // capped at math.MaxUint32, see Score64
+	Score64   uint64
+	Secondary uint64
+	db        *DB
+	key       []byte // posting key
 }
 
 func (d Document) IntID() (v uint64) {
@@ -69,6 +340,6 @@ func (d Document) String() string {
 		}
 	}
 	p = fmt.Sprintf(p, d.Index, d.ID)
-	p += fmt.Sprintf(", %d", d.Score)
+	p += fmt.Sprintf(", %d", d.Score64)
 	return p + ")"
 }
@@ -1,17 +1,25 @@
 package like
 
 import (
+	"bytes"
 	"compress/bzip2"
+	"encoding/binary"
 	"encoding/csv"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unsafe"
+
+	"github.com/coyove/bbolt"
 )
 
 var db DB
@@ -151,7 +159,7 @@ func createTemp() *DB {
 
 func TestMaxDocs(t *testing.T) {
 	db := createTemp()
-	defer db.Store.Close()
+	defer db.Close()
 
 	db.maxDocsTest = 10
 
@@ -212,7 +220,7 @@ func TestMaxDocs(t *testing.T) {
 
 func TestChar0(t *testing.T) {
 	db := createTemp()
-	defer db.Store.Close()
+	defer db.Close()
 
 	db.Index(IndexDocument{Content: "a b c d e f", Score: 1}.SetIntID(1))
 	db.Index(IndexDocument{Content: "d e f g h i", Score: 2}.SetIntID(2))
@@ -253,7 +261,7 @@ func TestChar0(t *testing.T) {
 
 func TestAuto(t *testing.T) {
 	db := createTemp()
-	defer db.Store.Close()
+	defer db.Close()
 
 	var m *Metrics
 	var N = 10
@@ -466,3 +474,1585 @@ func TestSearch(t *testing.T) {
 	fmt.Println(tot, hl)
 
 }
+
+func TestPercolate(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	db.RegisterQuery("world", "world")
+	db.RegisterQuery("home", "\"my home\" -world")
+	db.RegisterQuery("cjk", "跑步")
+	if err := db.RegisterQuery("empty", " "); err == nil {
+		t.Fatal("empty query")
+	}
+
+	names, _ := db.Percolate(IndexDocument{Content: "this is my world"})
+	if len(names) != 1 || names[0] != "world" {
+		t.Fatal(names)
+	}
+	names, _ = db.Percolate(IndexDocument{Content: "world is my home"})
+	if len(names) != 1 || names[0] != "world" {
+		t.Fatal(names)
+	}
+
+	matched := map[string][]string{}
+	db.OnPercolate = func(doc IndexDocument, names []string) {
+		matched[string(doc.ID)] = names
+	}
+	db.BatchIndex([]IndexDocument{
+		IndexDocument{Content: "my home"}.SetStringID("a"),
+		IndexDocument{Content: "不像我都不能跑步"}.SetStringID("b"),
+		IndexDocument{Content: "nothing"}.SetStringID("c"),
+	}, false)
+	if len(matched) != 2 || matched["a"][0] != "home" || matched["b"][0] != "cjk" {
+		t.Fatal(matched)
+	}
+
+	db.UnregisterQuery("cjk")
+	names, _ = db.Percolate(IndexDocument{Content: "不像我都不能跑步"})
+	if len(names) != 0 {
+		t.Fatal(names)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+	db.ChangeLog = true
+	db.maxDocsTest = 3
+
+	for i := 0; i < 5; i++ {
+		db.Index(IndexDocument{Content: "doc " + strconv.Itoa(i), Score: uint32(i)}.SetIntID(uint64(i)))
+	}
+	db.Index(IndexDocument{Rescore: true, Score: 100}.SetIntID(3))
+	db.Index(IndexDocument{Rescore: true, Score: 100}.SetIntID(999))
+	db.Delete(IndexDocument{}.SetIntID(4))
+
+	changes, err := db.Changes(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, c := range changes {
+		actions = append(actions, c.Action)
+	}
+	if fmt.Sprint(actions) != "[index index index index evict index evict rescore delete]" {
+		t.Fatal(changes)
+	}
+
+	path := filepath.Join(os.TempDir(), "replica.db")
+	os.Remove(path)
+	var replica DB
+	replica.OpenDefault(path)
+	replica.Namespace = "test"
+	defer replica.Close()
+
+	for since := uint64(0); ; {
+		changes, _ := db.Changes(since, 2)
+		if len(changes) == 0 {
+			break
+		}
+		if err := replica.Apply(changes); err != nil {
+			t.Fatal(err)
+		}
+		since = changes[len(changes)-1].Seq
+	}
+
+	res, _ := replica.Search("doc", nil, 10, nil)
+	if len(res) != 2 || res[0].IntID() != 3 || res[0].Score != 100 || res[1].IntID() != 2 {
+		t.Fatal(res)
+	}
+	if total, _, _ := replica.Count(); total != 2 {
+		t.Fatal(total)
+	}
+
+	db.TruncateChanges(changes[4].Seq)
+	if changes, _ = db.Changes(0, 100); len(changes) != 4 {
+		t.Fatal(changes)
+	}
+	if changes, err := db.Changes(math.MaxUint64, 100); err != nil || len(changes) != 0 {
+		t.Fatal(changes, err)
+	}
+
+	// A failing change doesn't stop the others.
+	err = replica.Apply([]Change{
+		{Action: "index", ID: []byte("a"), Content: "doc a"},
+		{Action: "bogus", ID: []byte("b")},
+		{Action: "index", ID: []byte("c"), Content: "doc c"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "bogus") {
+		t.Fatal(err)
+	}
+	if total, _, _ := replica.Count(); total != 4 {
+		t.Fatal(total)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	db := createTemp()
+	db.Index(IndexDocument{Content: "hello world", Score: 1}.SetIntID(1))
+	path := db.Store.Path()
+	db.Close()
+
+	var ro DB
+	if err := ro.OpenReadOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	ro.Namespace = "test"
+
+	res, _ := ro.Search("world", nil, 10, nil)
+	if len(res) != 1 || res[0].IntID() != 1 {
+		t.Fatal(res)
+	}
+	if err := ro.Index(IndexDocument{Content: "zzz"}.SetIntID(2)); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+	if err := ro.Delete(IndexDocument{}.SetIntID(1)); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+
+	shipped := filepath.Join(os.TempDir(), "shipped.db")
+	os.Remove(shipped)
+	var w DB
+	w.OpenDefault(shipped)
+	w.Namespace = "test"
+	w.Index(IndexDocument{Content: "hello world", Score: 2}.SetIntID(2))
+	w.Close()
+
+	if err := os.Rename(shipped, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	res, _ = ro.Search("world", nil, 10, nil)
+	if len(res) != 1 || res[0].IntID() != 2 {
+		t.Fatal(res)
+	}
+}
+
+func TestDurability(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "test.db")
+	for _, d := range []Durability{NoSync, SyncEveryCommit, GroupCommit} {
+		os.Remove(path)
+
+		var db DB
+		if err := db.Open(path, Options{Durability: d, GroupCommitInterval: time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+		db.Namespace = "test"
+		for i := 0; i < 10; i++ {
+			db.Index(IndexDocument{Content: "doc " + strconv.Itoa(i)}.SetIntID(uint64(i)))
+		}
+		if err := db.WaitDurable(); err != nil {
+			t.Fatal(err)
+		}
+		if id, _ := lastTxID(db.Store); d != SyncEveryCommit && db.durable < id {
+			t.Fatal(d, db.durable, id)
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&DB{Store: db.Store, Namespace: "other"}).WaitDurable(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db = DB{Namespace: "test"}
+		db.Open(path, Options{ReadOnly: true})
+		if total, _, _ := db.Count(); total != 10 {
+			t.Fatal(d, total)
+		}
+		db.Close()
+	}
+}
+
+func TestIndexer(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	ix := db.NewIndexer(16, 10*time.Millisecond)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				id := uint64(g*50 + i)
+				if err := <-ix.Index(IndexDocument{Content: "doc " + strconv.Itoa(int(id)), Score: uint32(id)}.SetIntID(id)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if total, _, _ := db.Count(); total != 400 {
+		t.Fatal(total)
+	}
+	if err := <-ix.Index(IndexDocument{}.SetIntID(1)); err == nil {
+		t.Fatal("empty document")
+	}
+
+	// Same ID indexed then rescored, all queued before the batch is flushed.
+	r1 := ix.Index(IndexDocument{Content: "first"}.SetIntID(1000))
+	r2 := ix.Index(IndexDocument{Content: "second"}.SetIntID(1000))
+	r3 := ix.Index(IndexDocument{Rescore: true, Score: 5000}.SetIntID(1000))
+	if <-r1 != nil || <-r2 != nil || <-r3 != nil {
+		t.Fatal("batch")
+	}
+	if ix.QueueLen() != 0 {
+		t.Fatal(ix.QueueLen())
+	}
+	res, _ := db.Search("second", nil, 10, nil)
+	if len(res) != 1 || res[0].IntID() != 1000 || res[0].Score != 5000 {
+		t.Fatal(res)
+	}
+	if res, _ = db.Search("first", nil, 10, nil); len(res) != 0 {
+		t.Fatal(res)
+	}
+
+	ix.Close()
+	if err := <-ix.Index(IndexDocument{Content: "late"}.SetIntID(1)); err != ErrIndexerClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestBulkLoader(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	l, err := db.NewBulkLoader(4096, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		content := fmt.Sprintf("doc %d mod%d 中文%d", i, i%7, i%3)
+		if err := l.Add(IndexDocument{Content: content, Score: uint32(i % 100)}.SetIntID(uint64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Add(IndexDocument{Content: "dup"}.SetIntID(0)); err == nil {
+		t.Fatal("duplicated ID")
+	}
+	l.Add(IndexDocument{Content: "   "}.SetIntID(5000))
+	if err := l.Finish(); err == nil {
+		t.Fatal("empty document")
+	}
+	if err := l.Add(IndexDocument{Content: "late"}.SetIntID(6000)); err == nil {
+		t.Fatal("add after finish")
+	}
+
+	if total, watermark, _ := db.Count(); total != 2000 || watermark != 2001 {
+		t.Fatal(total, watermark)
+	}
+	if _, err := db.NewBulkLoader(0, ""); err == nil {
+		t.Fatal("not empty")
+	}
+
+	ref := &DB{Store: db.Store, Namespace: "ref", MaxChars: db.MaxChars}
+	for i := 0; i < 2000; i++ {
+		content := fmt.Sprintf("doc %d mod%d 中文%d", i, i%7, i%3)
+		ref.Index(IndexDocument{Content: content, Score: uint32(i % 100)}.SetIntID(uint64(i)))
+	}
+
+	for _, q := range []string{"", "mod3", "中文2 -mod1", "doc 1999"} {
+		var a, b []uint64
+		for start := []byte(nil); ; {
+			res, next := db.Search(q, start, 77, nil)
+			for _, d := range res {
+				a = append(a, d.IntID())
+			}
+			if start = next; len(next) == 0 {
+				break
+			}
+		}
+		for start := []byte(nil); ; {
+			res, next := ref.Search(q, start, 77, nil)
+			for _, d := range res {
+				b = append(b, d.IntID())
+			}
+			if start = next; len(next) == 0 {
+				break
+			}
+		}
+		if len(a) == 0 || fmt.Sprint(a) != fmt.Sprint(b) {
+			t.Fatal(q, len(a), len(b))
+		}
+	}
+
+	res, _ := db.Search("doc 1999", nil, 1, nil)
+	if hl := res[0].Highlight(&Highlighter{Left: "<", Right: ">", Gap: 1}); hl != "<doc 1999>..." {
+		t.Fatal(hl)
+	}
+	db.Delete(IndexDocument{}.SetIntID(1999))
+	if res, _ = db.Search("doc 1999", nil, 1, nil); len(res) != 0 {
+		t.Fatal(res)
+	}
+
+	// Simulate a load interrupted after its first transaction.
+	partial := &DB{Store: db.Store, Namespace: "partial", MaxChars: db.MaxChars}
+	partial.Store.Update(func(tx *bbolt.Tx) error {
+		bkNs, _ := partial.createNamespace(tx, partial.Namespace)
+		cfg := partial.config()
+		cfg.Loading = true
+		return bkNs.Put(configKey, cfg.marshal())
+	})
+	if _, err := partial.NewBulkLoader(0, ""); !errors.Is(err, ErrUnfinishedLoad) {
+		t.Fatal(err)
+	}
+	if err := partial.Index(IndexDocument{Content: "x"}.SetIntID(1)); !errors.Is(err, ErrUnfinishedLoad) {
+		t.Fatal(err)
+	}
+	if err := partial.DropNamespace("partial"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := partial.NewBulkLoader(0, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for _, ns := range []string{"foo", "foobar", "bar"} {
+		db.Namespace = ns
+		db.Index(IndexDocument{Content: "hello " + ns}.SetStringID(ns))
+	}
+	db.Namespace = "foo"
+	db.RegisterQuery("q", "hello")
+
+	list, _ := db.ListNamespaces()
+	if fmt.Sprint(list) != "[bar foo foobar]" {
+		t.Fatal(list)
+	}
+
+	if err := db.RenameNamespace("foo", "bar"); err == nil {
+		t.Fatal("rename to existing")
+	}
+	if err := db.CopyNamespace("foo", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropNamespace("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RenameNamespace("foobar", "qux"); err != nil {
+		t.Fatal(err)
+	}
+
+	list, _ = db.ListNamespaces()
+	if fmt.Sprint(list) != "[bar baz qux]" {
+		t.Fatal(list)
+	}
+
+	for ns, id := range map[string]string{"bar": "bar", "baz": "foo", "qux": "foobar"} {
+		db.Namespace = ns
+		res, _ := db.Search("hello", nil, 10, nil)
+		if len(res) != 1 || res[0].StringID() != id {
+			t.Fatal(ns, res)
+		}
+		if total, _, _ := db.Count(); total != 1 {
+			t.Fatal(ns, total)
+		}
+	}
+
+	db.Namespace = "baz"
+	if q, _ := db.Queries(); q["q"] != "hello" {
+		t.Fatal(q)
+	}
+
+	db.Namespace = "fooindex"
+	db.Index(IndexDocument{Content: "x"}.SetStringID("x"))
+	db.Namespace = "foo"
+	db.Index(IndexDocument{Content: "x"}.SetStringID("x"))
+	if err := db.DropNamespace("foo"); err != nil {
+		t.Fatal(err)
+	}
+	db.Namespace = "fooindex"
+	if total, _, _ := db.Count(); total != 1 {
+		t.Fatal(total)
+	}
+}
+
+func TestMigrateLegacyLayout(t *testing.T) {
+	db := createTemp()
+	for _, ns := range []string{"foo", "foobar"} {
+		db.Namespace = ns
+		for i := 0; i < 10; i++ {
+			db.Index(IndexDocument{Content: ns + " " + strconv.Itoa(i), Score: uint32(i)}.SetIntID(uint64(i)))
+		}
+	}
+	db.Namespace = "foo"
+	db.RegisterQuery("q", "foo")
+
+	// Flatten nested buckets back into the legacy layout.
+	db.Store.Update(func(tx *bbolt.Tx) error {
+		return namespaces(tx).ForEachBucket(func(ns []byte) error {
+			return namespaces(tx).Bucket(ns).ForEachBucket(func(name []byte) error {
+				legacy := append([]byte(nil), ns...)
+				if string(name) != "id" {
+					legacy = append(legacy, name...)
+				}
+				dst, _ := tx.CreateBucket(legacy)
+				if err := copyBucket(dst, namespaces(tx).Bucket(ns).Bucket(name)); err != nil {
+					return err
+				}
+				if string(name) == "content" {
+					// Legacy contents are raw SCSU without codec ID.
+					var kvs [][2][]byte
+					dst.ForEach(func(k, v []byte) error {
+						kvs = append(kvs, [2][]byte{append([]byte(nil), k...), append([]byte(nil), v[1:]...)})
+						return nil
+					})
+					for _, kv := range kvs {
+						dst.Put(kv[0], kv[1])
+					}
+				}
+				return nil
+			})
+		})
+	})
+	db.Store.Update(func(tx *bbolt.Tx) error { return tx.DeleteBucket(rootBucket) })
+	path := db.Store.Path()
+	db.Close()
+
+	db = &DB{Namespace: "foo", ScoreBits: 64, SecondaryBits: 32}
+	if err := db.OpenDefault(path); err != ErrLegacyLayout {
+		t.Fatal(err)
+	}
+	if err := db.Open(path, Options{Migrate: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Migrated namespaces keep their key layout regardless of db's settings.
+	if err := db.CheckConfig(); !errors.Is(err, ErrConfigMismatch) {
+		t.Fatal(err)
+	}
+	if res, _ := db.Search("foo", nil, 20, nil); len(res) != 0 {
+		t.Fatal(res)
+	}
+	db.ScoreBits, db.SecondaryBits = 0, 0
+
+	list, _ := db.ListNamespaces()
+	if fmt.Sprint(list) != "[foo foobar]" {
+		t.Fatal(list)
+	}
+	for _, ns := range list {
+		db.Namespace = ns
+		res, _ := db.Search(ns, nil, 20, nil)
+		if len(res) != 10 || res[0].IntID() != 9 {
+			t.Fatal(ns, res)
+		}
+		if total, watermark, _ := db.Count(); total != 10 || watermark != 10 {
+			t.Fatal(ns, total, watermark)
+		}
+		if doc, _ := db.Get(res[0].ID); doc == nil || doc.Content != ns+" 9" {
+			t.Fatal(ns, doc)
+		}
+	}
+	db.Namespace = "foo"
+	if names, _ := db.Percolate(IndexDocument{Content: "foo"}); len(names) != 1 {
+		t.Fatal(names)
+	}
+	db.Store.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			if string(name) != string(rootBucket) {
+				t.Fatal(string(name))
+			}
+			return nil
+		})
+	})
+}
+
+func TestConfigMismatch(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 30; i++ {
+		db.Index(IndexDocument{Content: "hello world " + strconv.Itoa(i), Score: uint32(i % 10)}.SetIntID(uint64(i)))
+	}
+	db.Index(IndexDocument{Rescore: true, Score: 100}.SetIntID(5))
+	db.RegisterQuery("q", "world")
+	if err := db.CheckConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.MaxChars = 2
+	if err := db.CheckConfig(); !errors.Is(err, ErrConfigMismatch) {
+		t.Fatal(err)
+	}
+	if err := db.Index(IndexDocument{Content: "x"}.SetIntID(1)); !errors.Is(err, ErrConfigMismatch) {
+		t.Fatal(err)
+	}
+	m := &Metrics{}
+	if res, _ := db.Search("hello", nil, 10, m); len(res) != 0 || m.Error == "" {
+		t.Fatal(res, m.Error)
+	}
+
+	if err := db.Rebuild(7); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CheckConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if total, _, _ := db.Count(); total != 30 {
+		t.Fatal(total)
+	}
+	if res, _ := db.Search("wor", nil, 10, nil); len(res) != 0 {
+		t.Fatal(res)
+	}
+	res, _ := db.Search("hel", nil, 10, nil)
+	if len(res) != 10 || res[0].IntID() != 5 || res[0].Score != 100 || res[1].IntID() != 29 {
+		t.Fatal(res)
+	}
+	if q, _ := db.Queries(); q["q"] != "world" {
+		t.Fatal(q)
+	}
+	if list, _ := db.ListNamespaces(); fmt.Sprintf("%q", list) != `["test" "test\x00rebuild"]` {
+		t.Fatal(list)
+	}
+
+	// Leftover of an interrupted rebuild, and writes racing with the rebuild.
+	db.Store.Update(func(tx *bbolt.Tx) error {
+		bk, _ := db.createNamespace(tx, db.Namespace+"\x00rebuild2")
+		return bk.Put([]byte("stale"), []byte("1"))
+	})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			db.Delete(IndexDocument{}.SetIntID(uint64(i)))
+			db.Index(IndexDocument{Content: "hello new " + strconv.Itoa(i)}.SetIntID(uint64(100 + i)))
+		}
+	}()
+	if err := db.Rebuild(3); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if total, _, _ := db.Count(); total != 30 {
+		t.Fatal(total)
+	}
+	res, _ = db.Search("hel", nil, 100, nil)
+	var added int
+	for _, d := range res {
+		if d.IntID() < 10 {
+			t.Fatal("deleted", d.IntID())
+		}
+		if d.IntID() >= 100 {
+			added++
+		}
+	}
+	if len(res) != 30 || added != 10 {
+		t.Fatal(len(res), added)
+	}
+	if list, _ := db.ListNamespaces(); fmt.Sprintf("%q", list) != `["test" "test\x00rebuild2"]` {
+		t.Fatal(list)
+	}
+	db.Store.View(func(tx *bbolt.Tx) error {
+		if getNamespace(tx, db.Namespace).Get([]byte("stale")) != nil {
+			t.Fatal("leftover not dropped")
+		}
+		return nil
+	})
+}
+
+func TestReindex(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 50; i++ {
+		db.Index(IndexDocument{Content: "hello world " + strconv.Itoa(i), Score: uint32(i)}.SetIntID(uint64(i)))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 50; i < 80; i++ {
+			db.Index(IndexDocument{Content: "hello world " + strconv.Itoa(i), Score: uint32(i)}.SetIntID(uint64(i)))
+			db.Delete(IndexDocument{}.SetIntID(uint64(i - 50)))
+		}
+	}()
+
+	maxChars := db.MaxChars
+	if err := db.Reindex(db.Namespace, "v2", ReindexOptions{MaxChars: 2, ScoreBits: 64, BatchSize: 7}); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if db.MaxChars != 2 || db.ScoreBits != 64 {
+		t.Fatal(db.MaxChars, db.ScoreBits)
+	}
+
+	// Transactions after the switch but before db's settings are updated.
+	db.MaxChars, db.ScoreBits = maxChars, 0
+	m := &Metrics{}
+	if res, _ := db.Search("hel", nil, 100, m); len(res) != 50 || res[0].IntID() != 79 {
+		t.Fatal(len(res), m.Error)
+	}
+	if err := db.Index(IndexDocument{Content: "hello world 0", Score64: 1 << 40}.SetIntID(0)); err != nil {
+		t.Fatal(err)
+	}
+	db.MaxChars, db.ScoreBits = 2, 64
+	if res, _ := db.Search("hel", nil, 1, nil); len(res) != 1 || res[0].Score64 != 1<<40 {
+		t.Fatal(res)
+	}
+	db.Delete(IndexDocument{}.SetIntID(0))
+	if err := db.CheckConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if total, _, _ := db.Count(); total != 50 {
+		t.Fatal(total)
+	}
+	if res, _ := db.Search("wor", nil, 100, nil); len(res) != 0 {
+		t.Fatal(res)
+	}
+	res, _ := db.Search("hel", nil, 100, nil)
+	if len(res) != 50 || res[0].IntID() != 79 || res[49].IntID() != 30 {
+		t.Fatal(res)
+	}
+	if list, _ := db.ListNamespaces(); len(list) != 2 || list[1] != "v2" {
+		t.Fatal(list)
+	}
+	if err := db.Reindex(db.Namespace, "v2", ReindexOptions{}); err == nil {
+		t.Fatal("expect error")
+	}
+
+	// Aliases follow a renamed target and are removed with a dropped one.
+	if err := db.RenameNamespace("v2", "v3"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := db.ListNamespaces(); fmt.Sprint(list) != "[test v3]" {
+		t.Fatal(list)
+	}
+	if res, _ := db.Search("hel", nil, 100, nil); len(res) != 50 {
+		t.Fatal(res)
+	}
+	if err := db.DropNamespace("v3"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := db.ListNamespaces(); len(list) != 0 {
+		t.Fatal(list)
+	}
+	db.Index(IndexDocument{Content: "hello again"}.SetIntID(1))
+	if res, _ := db.Search("hel", nil, 100, nil); len(res) != 1 {
+		t.Fatal(res)
+	}
+	if list, _ := db.ListNamespaces(); fmt.Sprint(list) != "[test]" {
+		t.Fatal(list)
+	}
+}
+
+func TestDeleteCharZeroCount(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		db.Index(IndexDocument{Content: "hello " + strconv.Itoa(i)}.SetIntID(uint64(i)))
+	}
+	db.Index(IndexDocument{Content: "world"}.SetIntID(1))
+	db.Delete(IndexDocument{}.SetIntID(2))
+
+	db.Store.View(func(tx *bbolt.Tx) error {
+		if seq := db.namespace(tx).Bucket(runeBucket(0)).Sequence(); seq != 4 {
+			t.Fatal(seq)
+		}
+		return nil
+	})
+}
+
+func TestCheckRepair(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 30; i++ {
+		db.Index(IndexDocument{Content: "hello world " + strconv.Itoa(i), Score: uint32(i)}.SetIntID(uint64(i)))
+	}
+	db.Index(IndexDocument{Rescore: true, Score: 100}.SetIntID(3))
+	db.Delete(IndexDocument{}.SetIntID(4))
+	db.Index(IndexDocument{Content: "hello again", Score: 5}.SetIntID(5))
+	if p, err := db.Check(); err != nil || len(p) != 0 {
+		t.Fatal(p, err)
+	}
+
+	db.Store.Update(func(tx *bbolt.Tx) error {
+		bkNs := db.namespace(tx)
+		bkNs.Bucket(indexBucket).SetSequence(100)
+		var names [][]byte
+		bkNs.ForEachBucket(func(k []byte) error {
+			if len(k) == 4 && k[3] != 0 {
+				names = append(names, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		bk := bkNs.Bucket(names[0])
+		k, _ := bk.Cursor().First()
+		bk.Delete(append([]byte(nil), k...))
+		bk.Put(AppendSortedUvarint(binary.BigEndian.AppendUint32(nil, 7), 1000), []byte{0xff})
+		bkNs.Bucket(names[1]).SetSequence(1)
+		return nil
+	})
+	p, err := db.Check()
+	if err != nil || len(p) < 4 {
+		t.Fatal(p, err)
+	}
+
+	if err := db.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := db.Check(); err != nil || len(p) != 0 {
+		t.Fatal(p, err)
+	}
+	if total, _, _ := db.Count(); total != 29 {
+		t.Fatal(total)
+	}
+	res, _ := db.Search("hel", nil, 100, nil)
+	if len(res) != 29 || res[0].IntID() != 3 || res[0].Score != 100 {
+		t.Fatal(res)
+	}
+}
+
+func TestCompactTo(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		db.Index(IndexDocument{Content: "hello world " + strconv.Itoa(i), Score: uint32(i % 7)}.SetIntID(uint64(i)))
+	}
+	for i := 0; i < 200; i += 2 {
+		db.Delete(IndexDocument{}.SetIntID(uint64(i)))
+	}
+	db.Index(IndexDocument{Rescore: true, Score: 100}.SetIntID(5))
+	db.RegisterQuery("q", "world")
+
+	path := filepath.Join(t.TempDir(), "compact.db")
+	before, after, err := db.CompactTo(path, CompactOptions{Renumber: true, TxSize: 50})
+	if err != nil || before == 0 || after == 0 {
+		t.Fatal(before, after, err)
+	}
+	if _, _, err := db.CompactTo(path, CompactOptions{}); err == nil {
+		t.Fatal("expect error")
+	}
+
+	db2 := &DB{Namespace: db.Namespace}
+	if err := db2.OpenDefault(path); err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if p, err := db2.Check(); err != nil || len(p) != 0 {
+		t.Fatal(p, err)
+	}
+	if total, watermark, _ := db2.Count(); total != 100 || watermark != 100 {
+		t.Fatal(total, watermark)
+	}
+	res, _ := db2.Search("hel", nil, 200, nil)
+	if len(res) != 100 || res[0].IntID() != 5 || res[0].Score != 100 {
+		t.Fatal(res)
+	}
+	if q, _ := db2.Queries(); q["q"] != "world" {
+		t.Fatal(q)
+	}
+	db2.Index(IndexDocument{Content: "hello again"}.SetIntID(1000))
+	if _, watermark, _ := db2.Count(); watermark != 101 {
+		t.Fatal(watermark)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 50; i++ {
+		db.Index(IndexDocument{Content: "hello world " + strconv.Itoa(i), Score: uint32(i)}.SetIntID(uint64(i)))
+	}
+	db.RegisterQuery("q", "world")
+
+	buf := &bytes.Buffer{}
+	if err := db.BackupNamespace("test", buf); err != nil {
+		t.Fatal(err)
+	}
+	db.Index(IndexDocument{Content: "hello again"}.SetIntID(100))
+	db.Reindex("test", "test2", ReindexOptions{})
+	all := &bytes.Buffer{}
+	if err := db.Backup(all); err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := &DB{Namespace: "test"}
+	if err := db2.OpenDefault(filepath.Join(t.TempDir(), "restore.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if err := db2.Restore(bytes.NewReader(all.Bytes()), ""); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := db2.ListNamespaces(); len(list) != 2 {
+		t.Fatal(list)
+	}
+	if total, _, _ := db2.Count(); total != 51 {
+		t.Fatal(total)
+	}
+
+	if err := db2.Restore(bytes.NewReader(buf.Bytes()), "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db2.Restore(bytes.NewReader(buf.Bytes()), "copy"); err == nil {
+		t.Fatal("expect error")
+	}
+	if err := db2.Restore(bytes.NewReader(all.Bytes()), "copy2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db2.Restore(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), "bad"); err == nil {
+		t.Fatal("expect error")
+	}
+	if list, _ := db2.ListNamespaces(); len(list) != 4 {
+		t.Fatal(list)
+	}
+
+	db2.Namespace = "copy"
+	if p, err := db2.Check(); err != nil || len(p) != 0 {
+		t.Fatal(p, err)
+	}
+	res, _ := db2.Search("hel", nil, 100, nil)
+	if len(res) != 50 || res[0].IntID() != 49 {
+		t.Fatal(res)
+	}
+	if q, _ := db2.Queries(); q["q"] != "world" {
+		t.Fatal(q)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 30; i++ {
+		db.Index(IndexDocument{Content: "hello <world> " + strconv.Itoa(i), Score: uint32(i)}.SetIntID(uint64(i)))
+	}
+	db.Index(IndexDocument{Content: "你好世界", Score: 7}.SetStringID("zh"))
+
+	buf := &bytes.Buffer{}
+	if err := db.Export(buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("\n{bad json}\n{\"id\":\"\",\"content\":\"x\"}\n")
+
+	db.Namespace = "imported"
+	db.MaxChars = 2
+	var progress []int
+	n, err := db.Import(buf, ImportOptions{BatchSize: 8, OnProgress: func(n int) { progress = append(progress, n) }})
+	if n != 31 || err == nil || len(progress) != 4 || progress[3] != 31 {
+		t.Fatal(n, err, progress)
+	}
+	if errs := err.(interface{ Unwrap() []error }).Unwrap(); len(errs) != 2 {
+		t.Fatal(errs)
+	}
+
+	res, _ := db.Search("hel", nil, 100, nil)
+	if len(res) != 30 || res[0].IntID() != 29 {
+		t.Fatal(res)
+	}
+	res, _ = db.Search("你好", nil, 100, nil)
+	if len(res) != 1 || res[0].StringID() != "zh" || res[0].Score != 7 {
+		t.Fatal(res)
+	}
+}
+
+func TestGet(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	db.Index(IndexDocument{Content: "abc", Score: 3}.SetStringID("a"))
+	db.Index(IndexDocument{Content: "你好", Score: 4}.SetStringID("b"))
+	db.Index(IndexDocument{Rescore: true, Score: 5}.SetStringID("a"))
+
+	doc, err := db.Get([]byte("a"))
+	if err != nil || doc == nil || doc.Content != "abc" || doc.Score != 5 || doc.Index != 0 || doc.Grams == 0 {
+		t.Fatal(doc, err)
+	}
+	if doc, err := db.Get([]byte("c")); err != nil || doc != nil {
+		t.Fatal(doc, err)
+	}
+	docs, err := db.GetMany([][]byte{[]byte("b"), []byte("c"), []byte("a")})
+	if err != nil || len(docs) != 3 || docs[0].Content != "你好" || docs[0].Index != 1 || docs[1] != nil || docs[2].Score != 5 {
+		t.Fatal(docs, err)
+	}
+	chars, _ := Collect("你好", db.MaxChars)
+	if docs[0].Grams != len(chars) {
+		t.Fatal(docs[0].Grams, len(chars))
+	}
+}
+
+type mapProvider map[string]string
+
+func (m mapProvider) Content(id []byte) (string, error) {
+	if c, ok := m[string(id)]; ok {
+		return c, nil
+	}
+	return "", fmt.Errorf("not found")
+}
+
+func TestIndexOnly(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	texts := mapProvider{}
+	db.IndexOnly = true
+	db.ChangeLog = true
+	for i := 0; i < 20; i++ {
+		id := "doc" + strconv.Itoa(i)
+		texts[id] = "hello world " + id
+		db.Index(IndexDocument{Content: texts[id], Score: uint32(i)}.SetStringID(id))
+	}
+
+	db.Store.View(func(tx *bbolt.Tx) error {
+		if n := db.namespace(tx).Bucket(contentBucket).Stats().KeyN; n != 0 {
+			t.Fatal(n)
+		}
+		return nil
+	})
+
+	res, _ := db.Search("doc19", nil, 10, nil)
+	if len(res) != 1 || res[0].Highlight(&Highlighter{Left: "<", Right: ">"}) != "" {
+		t.Fatal(res)
+	}
+	if doc, _ := db.Get([]byte("doc19")); doc == nil || doc.Content != "" {
+		t.Fatal(doc)
+	}
+	if err := db.Repair(); err == nil {
+		t.Fatal("expect error")
+	}
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil || strings.Count(buf.String(), `"content":""`) != 20 {
+		t.Fatal(err, buf.String())
+	}
+	changes, _ := db.Changes(0, 100)
+	if len(changes) != 20 || changes[19].Content != "" {
+		t.Fatal(changes)
+	}
+	replica := &DB{Store: db.Store, Namespace: "replica", MaxChars: db.MaxChars, IndexOnly: true}
+	if err := replica.Apply(changes); err == nil {
+		t.Fatal("expect error")
+	}
+	replica.ContentProvider = texts
+	if err := replica.Apply(changes); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := replica.Search("doc19", nil, 10, nil); len(res) != 1 {
+		t.Fatal(res)
+	}
+
+	db.ContentProvider = texts
+	if hl := res[0].Highlight(&Highlighter{Left: "<", Right: ">"}); !strings.Contains(hl, "<doc19>") {
+		t.Fatal(hl)
+	}
+	if doc, _ := db.Get([]byte("doc19")); doc == nil || doc.Content != "hello world doc19" {
+		t.Fatal(doc)
+	}
+	if p, err := db.Check(); err != nil || len(p) != 0 {
+		t.Fatal(p, err)
+	}
+	delete(texts, "doc3")
+	if err := db.Repair(); err == nil {
+		t.Fatal("expect error")
+	}
+	if total, _, _ := db.Count(); total != 20 {
+		t.Fatal(total)
+	}
+	texts["doc3"] = "hello world doc3"
+	if err := db.Repair(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.MaxChars = 5
+	if err := db.Rebuild(7); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := db.Search("doc19", nil, 10, nil); len(res) != 0 {
+		t.Fatal(res)
+	}
+	if res, _ := db.Search("hell", nil, 100, nil); len(res) != 20 {
+		t.Fatal(res)
+	}
+}
+
+func TestContentCodec(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	long := strings.Repeat("the quick brown fox jumps over the lazy dog ", 50)
+	db.Index(IndexDocument{Content: long + "scsu"}.SetStringID("scsu"))
+	db.ContentCodec = FlateCodec
+	db.Index(IndexDocument{Content: long + "flate"}.SetStringID("flate"))
+
+	var samples []string
+	for i := 0; i < 10; i++ {
+		samples = append(samples, "the quick brown fox "+strconv.Itoa(i)+" jumps over the lazy dog")
+	}
+	dict := TrainDict(samples, 1024)
+	if len(dict) == 0 || len(dict) > 1024 || !bytes.Contains(dict, []byte("the lazy dog")) {
+		t.Fatal(string(dict))
+	}
+	dictCodec := NewDictCodec(16, dict)
+	db.ContentCodec = dictCodec
+	short := "the quick brown fox 100 jumps over the lazy dog"
+	db.Index(IndexDocument{Content: short}.SetStringID("dict"))
+
+	sizes := map[string]int{}
+	db.Store.View(func(tx *bbolt.Tx) error {
+		return db.namespace(tx).Bucket(contentBucket).ForEach(func(k, v []byte) error {
+			sizes[string(k)] = len(v)
+			return nil
+		})
+	})
+	if sizes["flate"] >= sizes["scsu"]/10 {
+		t.Fatal(sizes)
+	}
+	if enc, _ := FlateCodec.Encode(short); sizes["dict"] >= len(enc)+1 {
+		t.Fatal(sizes, len(enc))
+	}
+
+	docs, err := db.GetMany([][]byte{[]byte("scsu"), []byte("flate"), []byte("dict")})
+	if err != nil || docs[0].Content != long+"scsu" || docs[1].Content != long+"flate" || docs[2].Content != short {
+		t.Fatal(docs, err)
+	}
+
+	db.ContentCodec = nil
+	if _, err := db.Get([]byte("dict")); err == nil {
+		t.Fatal("expect error")
+	}
+	RegisterContentCodec(dictCodec)
+	defer contentCodecs.Delete(dictCodec.ID())
+	if doc, err := db.Get([]byte("dict")); err != nil || doc.Content != short {
+		t.Fatal(doc, err)
+	}
+	for _, c := range []ContentCodec{dictCodec, SCSUCodec} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expect panic", c.ID())
+				}
+			}()
+			RegisterContentCodec(c)
+		}()
+	}
+
+	// Reserved IDs belong to built-in codecs only.
+	db.ContentCodec = &flateCodec{id: 1, level: 1}
+	if doc, err := db.Get([]byte("scsu")); err != nil || doc.Content != long+"scsu" {
+		t.Fatal(doc, err)
+	}
+	if err := db.Index(IndexDocument{Content: short}.SetStringID("reserved")); err == nil {
+		t.Fatal("expect error")
+	}
+	if err := (&DB{ContentCodec: db.ContentCodec}).Open(filepath.Join(os.TempDir(), "codec.db"), Options{}); err == nil {
+		t.Fatal("expect error")
+	}
+	db.ContentCodec = nil
+	if p, err := db.Check(); err != nil || len(p) != 0 {
+		t.Fatal(p, err)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		db.Index(IndexDocument{Content: "doc " + strconv.Itoa(i), Score: uint32(i * 7 % 10)}.SetIntID(uint64(9 - i)))
+	}
+	db.Index(IndexDocument{Rescore: true, Score: 100}.SetIntID(0))
+
+	walk := func(order Order) (ids []uint64) {
+		var next []byte
+		for {
+			var n int
+			next, _ = db.ForEach(order, next, func(d Document) bool {
+				ids = append(ids, d.IntID())
+				n++
+				return n < 3
+			})
+			if next == nil {
+				return ids
+			}
+		}
+	}
+	if ids := walk(ByID); fmt.Sprint(ids) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Fatal(ids)
+	}
+	if ids := walk(ByIndex); fmt.Sprint(ids) != "[9 8 7 6 5 4 3 2 1 0]" {
+		t.Fatal(ids)
+	}
+	if ids := walk(ByScore); fmt.Sprint(ids) != "[0 2 5 8 1 4 7 3 6 9]" {
+		t.Fatal(ids)
+	}
+	var all []Document
+	db.ForEach(ByScore, nil, func(d Document) bool { all = append(all, d); return true })
+	res, _ := db.Search("", nil, 20, nil)
+	if fmt.Sprint(all) != fmt.Sprint(res) {
+		t.Fatal(all, res)
+	}
+}
+
+func TestSearchIDFilter(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		tenant := "a"
+		if i%3 == 0 {
+			tenant = "b"
+		}
+		content := "hello world " + strconv.Itoa(i)
+		if i%5 == 0 {
+			content = "goodbye " + strconv.Itoa(i)
+		}
+		db.Index(IndexDocument{Content: content, Score: uint32(i % 10)}.SetStringID(fmt.Sprintf("%s/%03d", tenant, i)))
+	}
+
+	search := func(query string, m Metrics) (ids []string) {
+		var next []byte
+		for {
+			m := m
+			var res []Document
+			res, next = db.Search(query, next, 7, &m)
+			for _, d := range res {
+				ids = append(ids, d.StringID())
+			}
+			if len(next) == 0 {
+				return ids
+			}
+		}
+	}
+	check := func(query string, m Metrics, filter func(id string) bool) {
+		for _, limit := range []int{10000, 1} {
+			db.maxIDCandidatesTest = limit
+			var expect []string
+			for _, id := range search(query, Metrics{}) {
+				if filter(id) {
+					expect = append(expect, id)
+				}
+			}
+			if got := search(query, m); len(expect) == 0 || fmt.Sprint(got) != fmt.Sprint(expect) {
+				t.Fatal(query, limit, got, expect)
+			}
+		}
+		db.maxIDCandidatesTest = 0
+	}
+
+	check("hel", Metrics{IDPrefix: []byte("a/")}, func(id string) bool { return id[0] == 'a' })
+	check("", Metrics{IDPrefix: []byte("b/")}, func(id string) bool { return id[0] == 'b' })
+	check("hel -9", Metrics{IDPrefix: []byte("b/")}, func(id string) bool { return id[0] == 'b' })
+	check("", Metrics{IDRange: [2][]byte{[]byte("a/050"), []byte("b/010")}}, func(id string) bool { return id >= "a/050" && id < "b/010" })
+	check("bye", Metrics{IDPrefix: []byte("a/"), IDRange: [2][]byte{nil, []byte("a/050")}}, func(id string) bool { return id >= "a/" && id < "a/050" })
+
+	m := &Metrics{IDPrefix: []byte("a/")}
+	db.Search("hel", nil, 10, m)
+	if m.IDCandidates != 66 {
+		t.Fatal(m.IDCandidates)
+	}
+	if res, _ := db.Search("hel", nil, 10, &Metrics{IDPrefix: []byte("c/")}); len(res) != 0 {
+		t.Fatal(res)
+	}
+
+	db.SearchTimeout = time.Nanosecond
+	m = &Metrics{IDPrefix: []byte("a/")}
+	if res, _ := db.Search("hel", nil, 10, m); len(res) != 0 || !m.Timeout || m.IDCandidates != 66 {
+		t.Fatal(res, m.Timeout)
+	}
+}
+
+func TestSearchScoreRange(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		content := "hello world " + strconv.Itoa(i)
+		if i%4 == 0 {
+			content = "goodbye world " + strconv.Itoa(i)
+		}
+		db.Index(IndexDocument{Content: content, Score: uint32(1000 + i/2)}.SetStringID(fmt.Sprintf("%03d", i)))
+	}
+
+	search := func(query string, m Metrics) (docs []Document) {
+		var next []byte
+		for {
+			m := m
+			var res []Document
+			res, next = db.Search(query, next, 4, &m)
+			docs = append(docs, res...)
+			if len(next) == 0 {
+				return docs
+			}
+		}
+	}
+	for _, query := range []string{"", "hel", "wor -bye", "wor -3"} {
+		all := search(query, Metrics{})
+		for _, m := range []Metrics{
+			{MinScore: 1010, MaxScore: 1020},
+			{MinScore: 1010, MaxScore: 1020, Ascending: true},
+			{MinScore: 1045},
+			{MaxScore: 1004, Ascending: true},
+			{Ascending: true},
+			{MinScore: 1010, MaxScore: 1020, Ascending: true, IDPrefix: []byte("03")},
+		} {
+			var expect []string
+			for _, d := range all {
+				if d.Score >= m.MinScore && (m.MaxScore == 0 || d.Score <= m.MaxScore) && bytes.HasPrefix(d.ID, m.IDPrefix) {
+					expect = append(expect, d.StringID())
+				}
+			}
+			if m.Ascending {
+				// Ties are ordered by index, which is also reversed.
+				for i, j := 0, len(expect)-1; i < j; i, j = i+1, j-1 {
+					expect[i], expect[j] = expect[j], expect[i]
+				}
+			}
+			var got []string
+			for _, d := range search(query, m) {
+				got = append(got, d.StringID())
+			}
+			if len(expect) == 0 || fmt.Sprint(got) != fmt.Sprint(expect) {
+				t.Fatal(query, m.MinScore, m.MaxScore, m.Ascending, got, expect)
+			}
+		}
+	}
+}
+
+func TestSearchPage(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 30; i++ {
+		db.Index(IndexDocument{Content: "hello world " + strconv.Itoa(i), Score: uint32(i / 3)}.SetIntID(uint64(i)))
+	}
+
+	for _, asc := range []bool{false, true} {
+		for _, query := range []string{"hel", "hel -2"} {
+			all, _ := db.Search(query, nil, 100, &Metrics{Ascending: asc})
+
+			var pages [][]Document
+			var cursor *SearchCursor
+			for {
+				res, prev, next, err := db.SearchPage(query, cursor, 4, &Metrics{Ascending: asc})
+				if err != nil || (cursor == nil) != (prev == nil) {
+					t.Fatal(err, prev)
+				}
+				pages = append(pages, res)
+				if next == nil {
+					break
+				}
+				if cursor, err = UnmarshalSearchCursor(next.Marshal()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var flat []Document
+			for _, p := range pages {
+				flat = append(flat, p...)
+			}
+			if fmt.Sprint(flat) != fmt.Sprint(all) {
+				t.Fatal(flat, all)
+			}
+
+			// Walk back from the last page.
+			_, cursor, _, _ = db.SearchPage(query, cursor, 4, &Metrics{Ascending: asc})
+			for i := len(pages) - 2; i >= 0; i-- {
+				res, prev, next, err := db.SearchPage(query, cursor, 4, &Metrics{Ascending: asc})
+				if err != nil || next == nil || fmt.Sprint(res) != fmt.Sprint(pages[i]) || (i == 0) != (prev == nil) {
+					t.Fatal(i, err, res, pages[i], prev)
+				}
+				cursor = prev
+			}
+		}
+	}
+
+	_, _, next, _ := db.SearchPage("hel", nil, 4, nil)
+	if _, _, _, err := db.SearchPage("wor", next, 4, nil); err != ErrCursorMismatch {
+		t.Fatal(err)
+	}
+	if _, _, _, err := db.SearchPage("hel", next, 4, &Metrics{MinScore: 2}); err != ErrCursorMismatch {
+		t.Fatal(err)
+	}
+	if _, err := UnmarshalSearchCursor("abc"); err != ErrInvalidCursor {
+		t.Fatal(err)
+	}
+
+	// A panicking backward walk leaves the caller's metrics untouched.
+	_, prev, _, _ := db.SearchPage("hel", next, 4, nil)
+	m := &Metrics{}
+	tx, _ := db.begin(false)
+	hash := db.searchHash(tx, "hel", m)
+	tx.Rollback()
+	func() {
+		defer func() { recover() }()
+		db.searchPage(hash, func(string, []byte, int, *Metrics) ([]Document, []byte) { panic("search") }, "hel", prev, 4, m)
+	}()
+	if prev.hash != hash {
+		t.Fatal(prev.hash, hash)
+	}
+	if m.Ascending {
+		t.Fatal("ascending flipped")
+	}
+
+	// Cursors don't survive a rebuild.
+	if err := db.Rebuild(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := db.SearchPage("hel", next, 4, nil); err != ErrCursorMismatch {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		db.Index(IndexDocument{Content: "hello world " + strconv.Itoa(i), Score: uint32(i)}.SetIntID(uint64(i)))
+	}
+
+	if _, err := db.Snapshot(0); err == nil {
+		t.Fatal("expect error")
+	}
+	snap, err := db.Snapshot(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, next := snap.Search("hel", nil, 5, nil)
+	if len(res) != 5 || res[0].IntID() != 19 {
+		t.Fatal(res)
+	}
+
+	// Move a document from the next page to the top, and delete one.
+	db.Index(IndexDocument{Rescore: true, Score: 100}.SetIntID(12))
+	db.Delete(IndexDocument{}.SetIntID(11))
+	res, _ = snap.Search("hel", next, 5, nil)
+	if len(res) != 5 || res[0].IntID() != 14 || res[2].IntID() != 12 || res[3].IntID() != 11 {
+		t.Fatal(res)
+	}
+	_, _, pageNext, _ := snap.SearchPage("hel", nil, 5, nil)
+	if res, _, _, _ := snap.SearchPage("hel", pageNext, 5, nil); len(res) != 5 || res[3].IntID() != 11 {
+		t.Fatal(res)
+	}
+	if res, _ := db.Search("hel", nil, 5, nil); res[0].IntID() != 12 {
+		t.Fatal(res)
+	}
+
+	snap.Close()
+	m := &Metrics{}
+	if res, _ := snap.Search("hel", nil, 5, m); len(res) != 0 || m.Error != ErrSnapshotExpired.Error() {
+		t.Fatal(res, m.Error)
+	}
+
+	snap, _ = db.Snapshot(50 * time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	if _, _, _, err := snap.SearchPage("hel", nil, 5, nil); err != ErrSnapshotExpired {
+		t.Fatal(err)
+	}
+
+	snap, _ = db.Snapshot(time.Hour)
+	snap.Search("hel", nil, 5, nil)
+	// Close must not wait for the lease.
+}
+
+func TestWideScores(t *testing.T) {
+	db := createTemp()
+	if err := db.Index(IndexDocument{Content: "hello", Score64: 1 << 40}.SetIntID(1)); err == nil {
+		t.Fatal("score should overflow")
+	}
+	if err := db.Index(IndexDocument{Content: "hello", Secondary: 1}.SetIntID(1)); err == nil {
+		t.Fatal("secondary key should be disabled")
+	}
+	db.Index(IndexDocument{Content: "hello", Score: 5}.SetIntID(1))
+	path := db.Store.Path()
+	db.Close()
+
+	db = &DB{Namespace: "test", ScoreBits: 64, SecondaryBits: 32, ChangeLog: true}
+	if err := db.OpenDefault(path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CheckConfig(); !errors.Is(err, ErrConfigMismatch) {
+		t.Fatal(err)
+	}
+	if err := db.Rebuild(0); err != nil {
+		t.Fatal(err)
+	}
+	if doc, _ := db.Get(IndexDocument{}.SetIntID(1).ID); doc == nil || doc.Score != 5 {
+		t.Fatal(doc)
+	}
+
+	for i := 2; i < 12; i++ {
+		db.Index(IndexDocument{Content: "hello " + strconv.Itoa(i), Score64: 1<<40 + uint64(i%3), Secondary: uint64(i)}.SetIntID(uint64(i)))
+	}
+	db.Index(IndexDocument{Rescore: true, Score64: 1<<40 + 2, Secondary: 100}.SetIntID(3))
+
+	var got []string
+	res, _ := db.Search("hel", nil, 20, &Metrics{MinScore64: 1<<40 + 1})
+	for _, d := range res {
+		got = append(got, fmt.Sprintf("%d/%d", d.IntID(), d.Secondary))
+	}
+	if fmt.Sprint(got) != "[3/100 11/11 8/8 5/5 2/2 10/10 7/7 4/4]" {
+		t.Fatal(got)
+	}
+	if doc, _ := db.Get(IndexDocument{}.SetIntID(3).ID); doc.Score64 != 1<<40+2 || doc.Score != math.MaxUint32 || doc.Secondary != 100 {
+		t.Fatal(doc)
+	}
+	if _, score, _ := db.GetIndexAndScore(IndexDocument{}.SetIntID(3).ID); score != math.MaxUint32 {
+		t.Fatal(score)
+	}
+	if _, score, _ := db.GetIndexAndScore64(IndexDocument{}.SetIntID(3).ID); score != 1<<40+2 {
+		t.Fatal(score)
+	}
+	if problems, err := db.Check(); err != nil || len(problems) > 0 {
+		t.Fatal(problems, err)
+	}
+
+	changes, _ := db.Changes(0, 100)
+	if c := changes[len(changes)-1]; c.Action != "rescore" || c.Score64 != 1<<40+2 || c.Secondary != 100 ||
+		!strings.Contains(c.String(), ", 1099511627778, 100, 0b)") {
+		t.Fatal(c)
+	}
+	if err := db.Index(IndexDocument{Content: "hello", Secondary: 1 << 32}.SetIntID(1)); err == nil {
+		t.Fatal("secondary key should overflow")
+	}
+}
+
+func TestRescore(t *testing.T) {
+	db := createTemp()
+	defer db.Close()
+	for i := 0; i < 5; i++ {
+		db.Index(IndexDocument{Content: "hello " + strconv.Itoa(i), Score: 10}.SetIntID(uint64(i)))
+	}
+	id := func(i uint64) []byte { return IndexDocument{}.SetIntID(i).ID }
+
+	res, err := db.Rescore([]ScoreUpdate{
+		{ID: id(0), Mode: RescoreIfGreater, Score: 5},
+		{ID: id(1), Mode: RescoreIfGreater, Score: 20},
+		{ID: id(2), Mode: RescoreIncrement, Delta: 3},
+		{ID: id(2), Mode: RescoreIncrement, Delta: 4},
+		{ID: id(3), Mode: RescoreIncrement, Delta: -100},
+		{ID: id(4), Mode: RescoreSet, Score: 1},
+		{ID: id(9), Mode: RescoreSet, Score: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res) != "[{true false 10 0} {true true 10 0} {true true 10 0} {true true 13 0} {true true 10 0} {true true 10 0} {false false 0 0}]" {
+		t.Fatal(res)
+	}
+	var got []string
+	docs, _ := db.Search("", nil, 10, nil)
+	for _, d := range docs {
+		got = append(got, fmt.Sprintf("%d:%d", d.IntID(), d.Score))
+	}
+	if fmt.Sprint(got) != "[1:20 2:17 0:10 4:1 3:0]" {
+		t.Fatal(got)
+	}
+
+	// Nothing is applied if any update fails.
+	if _, err := db.Rescore([]ScoreUpdate{
+		{ID: id(0), Mode: RescoreSet, Score: 99},
+		{ID: id(1), Mode: RescoreSet, Score: 1 << 40},
+	}); err == nil {
+		t.Fatal("score should overflow")
+	}
+	if res, _ := db.Rescore([]ScoreUpdate{{ID: id(1), Mode: RescoreIncrement, Delta: 1 << 40}}); res[0].Score != 20 {
+		t.Fatal(res)
+	}
+	if doc, _ := db.Get(id(0)); doc.Score != 10 {
+		t.Fatal(doc)
+	}
+	if doc, _ := db.Get(id(1)); doc.Score != math.MaxUint32 {
+		t.Fatal(doc)
+	}
+	if problems, err := db.Check(); err != nil || len(problems) > 0 {
+		t.Fatal(problems, err)
+	}
+	if _, err := db.Rescore([]ScoreUpdate{{ID: id(9), Mode: RescoreIfOlder, Score: 1, Secondary: 1}}); err == nil {
+		t.Fatal("secondary keys are disabled")
+	}
+}
+
+func TestRescoreIfOlder(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "test.db")
+	os.Remove(path)
+	db := &DB{Namespace: "test", SecondaryBits: 64}
+	if err := db.OpenDefault(path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Index(IndexDocument{Content: "hello", Score: 10, Secondary: 100}.SetIntID(1))
+	id := IndexDocument{}.SetIntID(1).ID
+
+	res, _ := db.Rescore([]ScoreUpdate{
+		{ID: id, Mode: RescoreIfOlder, Score: 11, Secondary: 99},
+		{ID: id, Mode: RescoreIfOlder, Score: 12, Secondary: 101},
+		{ID: id, Mode: RescoreIfOlder, Score: 13, Secondary: 101},
+	})
+	if !(!res[0].Applied && res[1].Applied && !res[2].Applied) || res[2].Score != 12 || res[2].Secondary != 101 {
+		t.Fatal(res)
+	}
+	if docs, _ := db.Search("hel", nil, 1, nil); docs[0].Score != 12 || docs[0].Secondary != 101 {
+		t.Fatal(docs)
+	}
+}
+
+func TestRank(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "test.db")
+	os.Remove(path)
+	db := &DB{Namespace: "test", SecondaryBits: 64}
+	if err := db.OpenDefault(path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Timestamps are whole seconds, so is now, otherwise Decay is off by the fraction.
+	now := time.Unix(time.Now().Unix(), 0)
+	for i, ageDays := range []int{10, 0, 3, 1, 30} {
+		ts := uint64(now.Add(-time.Duration(ageDays) * 24 * time.Hour).Unix())
+		db.Index(IndexDocument{Content: "hello " + strconv.Itoa(i), Score: uint32(100 - i*10), Secondary: ts}.SetIntID(uint64(i)))
+	}
+
+	m := &Metrics{Rank: func(d Document) float64 {
+		return float64(d.Score) * Decay(d.Secondary, now, 24*time.Hour)
+	}}
+	search := func(n int) (ids []uint64) {
+		res, next := db.Search("hel", nil, n, m)
+		if next != nil {
+			t.Fatal(next)
+		}
+		for _, d := range res {
+			ids = append(ids, d.IntID())
+		}
+		return ids
+	}
+	if ids := search(3); fmt.Sprint(ids) != "[1 3 2]" {
+		t.Fatal(ids)
+	}
+	m.RankWindow = 3
+	if ids := search(2); fmt.Sprint(ids) != "[1 2]" {
+		t.Fatal(ids)
+	}
+	if m.Rank == nil {
+		t.Fatal("Rank should be kept")
+	}
+	m.Deduplicator = func(Document) bool { panic("dedup") }
+	func() {
+		defer func() { recover() }()
+		db.Search("hel", nil, 2, m)
+	}()
+	if m.Rank == nil {
+		t.Fatal("Rank should be kept after a panic")
+	}
+	if d := Decay(uint64(now.Add(-48*time.Hour).Unix()), now, 24*time.Hour); math.Abs(d-0.25) > 1e-6 {
+		t.Fatal(d)
+	}
+}
@@ -0,0 +1,136 @@
+package like
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// exportDoc is one line of Export. IDs which are not valid UTF-8 are base64 encoded.
+type exportDoc struct {
+	ID         string `json:"id"`
+	IDEncoding string `json:"id_encoding,omitempty"`
+	Score      uint64 `json:"score"`
+	Secondary  uint64 `json:"secondary,omitempty"`
+	Content    string `json:"content"`
+}
+
+func (d exportDoc) document() (doc IndexDocument, err error) {
+	switch d.IDEncoding {
+	case "":
+		doc.ID = []byte(d.ID)
+	case "base64":
+		if doc.ID, err = base64.StdEncoding.DecodeString(d.ID); err != nil {
+			return doc, err
+		}
+	default:
+		return doc, fmt.Errorf("unknown ID encoding %q", d.IDEncoding)
+	}
+	doc.Score64 = d.Score
+	doc.Secondary = d.Secondary
+	doc.Content = d.Content
+	return doc, nil
+}
+
+// Export writes every document of the namespace to w as one JSON object per line,
+// in ID order, from a single consistent snapshot. Like GetMany, documents indexed with
+// IndexOnly are written with empty contents if db.ContentProvider is not set.
+func (db *DB) Export(w io.Writer) error {
+	tx, err := db.begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
+		return nil
+	}
+	l := namespaceKeyLayout(bkNs)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	err = bkNs.Bucket(idBucket).ForEach(func(id, payload []byte) error {
+		_, score, secondary, _ := l.payloadHeader(payload)
+		content, err := db.content(bkNs, id)
+		if err != nil && err != errContentNotStored {
+			return fmt.Errorf("document %x: content: %v", id, err)
+		}
+		d := exportDoc{ID: string(id), Score: score, Secondary: secondary, Content: content}
+		if !utf8.Valid(id) {
+			d.ID, d.IDEncoding = base64.StdEncoding.EncodeToString(id), "base64"
+		}
+		return enc.Encode(d)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+type ImportOptions struct {
+	BatchSize  int
+	OnProgress func(imported int)
+}
+
+// Import reads documents written by Export from r and indexes them through BatchIndex.
+// Invalid lines and documents which fail to index are skipped, their errors are joined
+// and returned along with the number of documents imported.
+func (db *DB) Import(r io.Reader, opts ImportOptions) (imported int, err error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	var errs []error
+	var docs []IndexDocument
+	var lines []int
+	flush := func() {
+		for i, err := range db.BatchIndex(docs, false) {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %v", lines[i], err))
+			} else {
+				imported++
+			}
+		}
+		docs, lines = docs[:0], lines[:0]
+		if opts.OnProgress != nil {
+			opts.OnProgress(imported)
+		}
+	}
+
+	rd := bufio.NewReader(r)
+	for ln := 1; ; ln++ {
+		line, err := rd.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var d exportDoc
+			var doc IndexDocument
+			err := json.Unmarshal(line, &d)
+			if err == nil {
+				doc, err = d.document()
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %v", ln, err))
+			} else {
+				docs, lines = append(docs, doc), append(lines, ln)
+			}
+			if len(docs) >= opts.BatchSize {
+				flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, errors.Join(append(errs, err)...)
+		}
+	}
+	if len(docs) > 0 {
+		flush()
+	}
+	return imported, errors.Join(errs...)
+}
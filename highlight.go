@@ -8,7 +8,6 @@ import (
 	"unicode/utf8"
 
 	"github.com/coyove/like/array16"
-	"github.com/dop251/scsu"
 )
 
 type Metrics struct {
@@ -20,6 +19,24 @@ type Metrics struct {
 
 	Deduplicator func(Document) bool `json:"-"`
 
+	// IDPrefix and IDRange ([start, end), nil means unbounded) restrict results by document ID.
+	IDPrefix     []byte    `json:"-"`
+	IDRange      [2][]byte `json:"-"`
+	IDCandidates int       `json:"id_candidates,omitempty"`
+
+	// MinScore and MaxScore (0 means unbounded) restrict results by score inclusively.
+	// MinScore64 and MaxScore64 are used instead if not zero.
+	MinScore   uint32 `json:"-"`
+	MaxScore   uint32 `json:"-"`
+	MinScore64 uint64 `json:"-"`
+	MaxScore64 uint64 `json:"-"`
+	Ascending  bool   `json:"-"` // lowest scores first
+
+	// Rank orders results at query time: the first RankWindow matches (1000 if zero)
+	// are ranked and the top n are returned, next is always nil.
+	Rank       func(Document) float64 `json:"-"`
+	RankWindow int                    `json:"-"`
+
 	Query          string `json:"query"`
 	Error          string `json:"error"`
 	Seek           int    `json:"seek"`
@@ -47,6 +64,30 @@ func (d *Metrics) Collect(term string, maxChars uint16) (parts []rune) {
 	return
 }
 
+// idBounds returns the ID range [lo, hi) combined from IDPrefix and IDRange.
+func (d *Metrics) idBounds() (lo, hi []byte, ok bool) {
+	lo, hi = d.IDRange[0], d.IDRange[1]
+	if len(d.IDPrefix) > 0 {
+		if bytes.Compare(d.IDPrefix, lo) > 0 {
+			lo = d.IDPrefix
+		}
+		if end := prefixEnd(d.IDPrefix); end != nil && (hi == nil || bytes.Compare(end, hi) < 0) {
+			hi = end
+		}
+	}
+	return lo, hi, len(lo) > 0 || hi != nil
+}
+
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i]++; end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 func (d *Metrics) String() string {
 	buf, _ := json.Marshal(d)
 	return string(buf)
@@ -59,19 +100,17 @@ type Highlighter struct {
 }
 
 func (d Document) Highlight(hl *Highlighter) (out string) {
-	tx, err := d.db.Store.Begin(false)
+	tx, err := d.db.begin(false)
 	if err != nil {
 		return ""
 	}
 	defer tx.Rollback()
 
-	bk := tx.Bucket([]byte(d.db.Namespace + "content"))
-	if bk == nil {
+	bkNs := d.db.namespace(tx)
+	if bkNs == nil {
 		return ""
 	}
-	data := bk.Get(d.ID)
-
-	content, _ := scsu.Decode(data)
+	content, _ := d.db.content(bkNs, d.ID)
 	if len(d.Segs) == 0 || len(content) == 0 {
 		return ""
 	}
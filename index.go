@@ -8,14 +8,25 @@ import (
 
 	"github.com/coyove/bbolt"
 	"github.com/coyove/like/array16"
-	"github.com/dop251/scsu"
 )
 
 type IndexDocument struct {
 	ID      []byte
 	Rescore bool
 	Score   uint32
-	Content string
+	// Score64 is used instead of Score if not zero, scores over 32 bits require
+	// DB.ScoreBits 64.
+	Score64 uint64
+	// Secondary orders documents of equal scores, it requires DB.SecondaryBits.
+	Secondary uint64
+	Content   string
+}
+
+func (d IndexDocument) score() uint64 {
+	if d.Score64 != 0 {
+		return d.Score64
+	}
+	return uint64(d.Score)
 }
 
 func (d IndexDocument) SetID(v []byte) IndexDocument {
@@ -35,9 +46,9 @@ func (d IndexDocument) SetStringID(v string) IndexDocument {
 
 func (d IndexDocument) String() string {
 	if d.Rescore {
-		return fmt.Sprintf("RescoreDocument(%x, %d)", d.ID, d.Score)
+		return fmt.Sprintf("RescoreDocument(%x, %d)", d.ID, d.score())
 	}
-	return fmt.Sprintf("IndexDocument(%x, %d, %db)", d.ID, d.Score, len(d.Content))
+	return fmt.Sprintf("IndexDocument(%x, %d, %db)", d.ID, d.score(), len(d.Content))
 }
 
 func (db *DB) Index(doc IndexDocument) error {
@@ -55,7 +66,7 @@ func (db *DB) BatchIndex(docs []IndexDocument, sortInsert bool) []error {
 	}
 
 	errs := make([]error, len(docs))
-	tx, err := db.Store.Begin(true)
+	tx, err := db.begin(true)
 	if err != nil {
 		for i := range errs {
 			errs[i] = err
@@ -64,95 +75,47 @@ func (db *DB) BatchIndex(docs []IndexDocument, sortInsert bool) []error {
 	}
 	defer tx.Rollback()
 
-	for i, doc := range docs {
-		contentBytes, err := scsu.Encode(doc.Content, nil)
-		if err != nil {
-			errs[i] = fmt.Errorf("invalid document content: %v", err)
-			continue
-		}
-		chars, _ := Collect(doc.Content, db.MaxChars)
-		if len(doc.ID) == 0 {
-			errs[i] = fmt.Errorf("empty document ID")
-			continue
-		}
-		if len(doc.ID) > bbolt.MaxKeySize {
-			errs[i] = fmt.Errorf("document ID too large")
-			continue
-		}
-		if len(chars) == 0 && !doc.Rescore {
-			errs[i] = fmt.Errorf("empty document")
-			continue
-		}
-		if _, ok := chars[0]; ok {
-			panic("BUG")
-		}
-
-		if doc.Rescore {
-			deleteTx(tx, db.Namespace, doc.ID, "rescore", doc.Score)
-			continue
+	var cfg nsConfig
+	bkNs, err := db.createNamespace(tx, db.Namespace)
+	if err == nil {
+		cfg, err = db.checkConfig(bkNs)
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
 		}
+		return errs
+	}
 
-		bkId, index := deleteTx(tx, db.Namespace, doc.ID, "index", 0)
-
-		newScore := binary.BigEndian.AppendUint32(nil, doc.Score)
+	var percolates []map[rune][]byte
+	if db.OnPercolate != nil {
+		percolates = make([]map[rune][]byte, len(docs))
+	}
 
-		var tmp []byte
-		var runes1 []uint16
-		var runes2 []uint32
+	shadow, bkShadow := db.shadowTx(tx)
 
-		chars[0] = nil
-		for k, v := range chars {
-			k := uint32(k)
-			if k < 0xFFFF {
-				runes1 = append(runes1, uint16(k))
-			} else {
-				runes2 = append(runes2, k)
-			}
-			// if len(v) > 1000 {
-			// 	fmt.Println(string(k), len(v), array16.Len(v))
-			// }
-			tmp = binary.BigEndian.AppendUint32(append(tmp[:0], db.Namespace...), k)
-			bk, _ := tx.CreateBucketIfNotExists(tmp)
-			bk.SetSequence(bk.Sequence() + 1)
-			bk.Put(AppendSortedUvarint(newScore, index), v)
+	for i, doc := range docs {
+		chars, err := db.indexTx(bkNs, cfg, doc, sortInsert)
+		if err != nil {
+			errs[i] = err
+			continue
 		}
-
-		payload := AppendSortedUvarint(nil, index)
-		payload = binary.BigEndian.AppendUint32(payload, doc.Score)
-
-		buf1 := array16.Compress(runes1)
-		payload = binary.AppendUvarint(payload, uint64(len(buf1)))
-		payload = append(payload, buf1...)
-		payload = binary.AppendUvarint(payload, uint64(len(runes2)))
-		for _, k := range runes2 {
-			k -= 0x10000
-			if k > 0xFFFFFF {
-				errs[i] = fmt.Errorf("invalid unicode %x", k+0x10000)
-				continue
-			}
-			payload = append(payload, byte(k>>16), byte(k>>8), byte(k))
+		if shadow != nil {
+			shadow.indexTx(bkShadow, shadow.config(), doc, sortInsert)
 		}
-
-		bkContent, _ := tx.CreateBucketIfNotExists([]byte(db.Namespace + "content"))
-
-		if sortInsert {
-			bkId.FillPercent = 95
-			bkContent.FillPercent = 95
+		if percolates != nil && !doc.Rescore {
+			percolates[i] = chars
 		}
-
-		bkId.Put(doc.ID, payload)
-		bkContent.Put(doc.ID, contentBytes)
 	}
 
 	if db.maxDocsTest > 0 {
-		bkIndex, _ := tx.CreateBucketIfNotExists([]byte(db.Namespace + "index"))
-		if diff := bkIndex.Sequence() - db.maxDocsTest; diff > 0 {
-			db.evict(tx, int(diff))
+		if diff := bkNs.Bucket(indexBucket).Sequence() - db.maxDocsTest; diff > 0 {
+			db.evict(bkNs, cfg.keyLayout(), int(diff))
 		}
 	}
 
 	if db.FreelistRange != [2]int{} {
-		stats := db.Store.Stats()
+		stats := tx.DB().Stats()
 		size := stats.FreePageN + stats.PendingPageN
 
 		if db.cfls > 0 {
@@ -160,12 +123,12 @@ func (db *DB) BatchIndex(docs []IndexDocument, sortInsert bool) []error {
 				db.cfls = 0
 			} else {
 				db.cfls = db.cfls/2 + len(docs)
-				db.evict(tx, db.cfls)
+				db.evict(bkNs, cfg.keyLayout(), db.cfls)
 			}
 		} else {
 			if size < db.FreelistRange[0] {
 				db.cfls = len(docs) * 2
-				db.evict(tx, db.cfls)
+				db.evict(bkNs, cfg.keyLayout(), db.cfls)
 			}
 		}
 	}
@@ -174,50 +137,292 @@ func (db *DB) BatchIndex(docs []IndexDocument, sortInsert bool) []error {
 		for i := range errs {
 			errs[i] = err
 		}
+		return errs
+	}
+
+	for i, chars := range percolates {
+		if chars == nil || errs[i] != nil {
+			continue
+		}
+		if names, _ := db.percolate(chars); len(names) > 0 {
+			db.OnPercolate(docs[i], names)
+		}
 	}
 	return errs
 }
 
+// indexTx indexes doc into bkNs, whose config is cfg.
+func (db *DB) indexTx(bkNs *bbolt.Bucket, cfg nsConfig, doc IndexDocument, sortInsert bool) (map[rune][]byte, error) {
+	contentBytes, err := db.encodeContent(doc.Content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document content: %v", err)
+	}
+	chars, _ := Collect(doc.Content, cfg.MaxChars)
+	if len(doc.ID) == 0 {
+		return nil, fmt.Errorf("empty document ID")
+	}
+	if len(doc.ID) > bbolt.MaxKeySize {
+		return nil, fmt.Errorf("document ID too large")
+	}
+	if len(chars) == 0 && !doc.Rescore {
+		return nil, fmt.Errorf("empty document")
+	}
+	if _, ok := chars[0]; ok {
+		panic("BUG")
+	}
+	if doc.Rescore {
+		return nil, db.rescoreTx(bkNs, cfg.keyLayout(), doc.ID, doc.score(), doc.Secondary)
+	}
+	l := cfg.keyLayout()
+	score := doc.score()
+	if err := l.check(score, doc.Secondary); err != nil {
+		return nil, err
+	}
+
+	bkId, index := deleteTx(bkNs, l, doc.ID, "index", 0, 0)
+
+	key := l.postingKey(score, doc.Secondary, index)
+
+	var tmp []byte
+
+	chars[0] = nil
+	for k, v := range chars {
+		// if len(v) > 1000 {
+		// 	fmt.Println(string(k), len(v), array16.Len(v))
+		// }
+		tmp = binary.BigEndian.AppendUint32(tmp[:0], uint32(k))
+		bk, _ := bkNs.CreateBucketIfNotExists(tmp)
+		bk.SetSequence(bk.Sequence() + 1)
+		bk.Put(key, v)
+	}
+
+	payload, err := l.encodePayload(index, score, doc.Secondary, chars)
+
+	bkContent := bkNs.Bucket(contentBucket)
+
+	if sortInsert {
+		bkId.FillPercent = 95
+		bkContent.FillPercent = 95
+	}
+
+	bkId.Put(doc.ID, payload)
+	c := Change{Action: "index", ID: doc.ID, Score: score32(score), Score64: score, Secondary: doc.Secondary, Content: doc.Content}
+	if db.IndexOnly {
+		bkContent.Delete(doc.ID)
+		c.Content = ""
+	} else {
+		bkContent.Put(doc.ID, contentBytes)
+	}
+	db.logChange(bkNs, c)
+	return chars, err
+}
+
+// rescoreTx moves postings of document id to a new score and secondary key, missing
+// documents are ignored.
+func (db *DB) rescoreTx(bkNs *bbolt.Bucket, l keyLayout, id []byte, score, secondary uint64) error {
+	if err := l.check(score, secondary); err != nil {
+		return err
+	}
+	if bk, _ := deleteTx(bkNs, l, id, "rescore", score, secondary); bk != nil {
+		db.logChange(bkNs, Change{Action: "rescore", ID: id, Score: score32(score), Score64: score, Secondary: secondary})
+	}
+	return nil
+}
+
 func (db *DB) Delete(doc IndexDocument) error {
-	tx, err := db.Store.Begin(true)
+	tx, err := db.begin(true)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	deleteTx(tx, db.Namespace, doc.ID, "delete", 0)
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
+		return nil
+	}
+	if bk, _ := deleteTx(bkNs, namespaceKeyLayout(bkNs), doc.ID, "delete", 0, 0); bk != nil {
+		db.logChange(bkNs, Change{Action: "delete", ID: doc.ID})
+	}
+	if shadow, bkShadow := db.shadowTx(tx); bkShadow != nil {
+		deleteTx(bkShadow, shadow.config().keyLayout(), doc.ID, "delete", 0, 0)
+	}
 
 	return tx.Commit()
 }
 
+// GetIndexAndScore returns the index and score of a document, scores over 32 bits are
+// capped at math.MaxUint32, see GetIndexAndScore64.
 func (db *DB) GetIndexAndScore(docID []byte) (uint64, uint32, error) {
-	tx, err := db.Store.Begin(false)
+	index, score, err := db.GetIndexAndScore64(docID)
+	return index, score32(score), err
+}
+
+func (db *DB) GetIndexAndScore64(docID []byte) (uint64, uint64, error) {
+	tx, err := db.begin(false)
 	if err != nil {
 		return 0, 0, err
 	}
 	defer tx.Rollback()
 
-	bkId := tx.Bucket([]byte(db.Namespace))
-	if bkId == nil {
-		return 0, 0, nil
-	}
-	payload := bkId.Get(docID)
-	if len(payload) == 0 {
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
 		return 0, 0, nil
 	}
-	index, w := SortedUvarint(payload)
-	score := binary.BigEndian.Uint32(payload[w:])
+	index, score, _, _ := namespaceKeyLayout(bkNs).payloadHeader(bkNs.Bucket(idBucket).Get(docID))
 	return index, score, nil
 }
 
-func deleteTx(tx *bbolt.Tx, ns string, id8 []byte, action string, rescore uint32) (*bbolt.Bucket, uint64) {
-	bkId, _ := tx.CreateBucketIfNotExists([]byte(ns))
-	bkIndex, _ := tx.CreateBucketIfNotExists([]byte(ns + "index"))
-	bkContent, _ := tx.CreateBucketIfNotExists([]byte(ns + "content"))
+type StoredDocument struct {
+	ID        []byte
+	Index     uint64
+	Score     uint32 // capped at math.MaxUint32, see Score64
+	Score64   uint64
+	Secondary uint64
+	Grams     int // number of distinct chars and trigrams indexed
+	Content   string
+}
+
+// Get returns the stored document with the given ID, or nil if not found.
+func (db *DB) Get(id []byte) (*StoredDocument, error) {
+	docs, err := db.GetMany([][]byte{id})
+	if err != nil {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// GetMany returns stored documents of ids in one transaction, missing ones are nil.
+func (db *DB) GetMany(ids [][]byte) ([]*StoredDocument, error) {
+	tx, err := db.begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res := make([]*StoredDocument, len(ids))
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
+		return res, nil
+	}
+	bkId, l := bkNs.Bucket(idBucket), namespaceKeyLayout(bkNs)
+	for i, id := range ids {
+		payload := bkId.Get(id)
+		if payload == nil {
+			continue
+		}
+		doc := &StoredDocument{ID: append([]byte(nil), id...)}
+		var rest []byte
+		doc.Index, doc.Score64, doc.Secondary, rest = l.payloadHeader(payload)
+		doc.Score = score32(doc.Score64)
+		foreachPayload(false, rest, func(r uint32) {
+			if r != 0 {
+				doc.Grams++
+			}
+		})
+		if doc.Content, err = db.content(bkNs, id); err == errContentNotStored {
+			doc.Content = ""
+		} else if err != nil {
+			return nil, fmt.Errorf("document %x: content: %v", id, err)
+		}
+		res[i] = doc
+	}
+	return res, nil
+}
+
+type Order int
+
+const (
+	ByID    Order = iota // ascending document IDs
+	ByIndex              // insertion order
+	ByScore              // descending scores, same as Search
+)
+
+// ForEach calls f with documents of the namespace in the given order, starting from
+// cursor start (inclusive, nil to start from the beginning), until f returns false.
+// It returns the cursor of the next unvisited document, nil if all are visited.
+// Documents are read from a single transaction, Segs are not filled.
+func (db *DB) ForEach(order Order, start []byte, f func(Document) bool) (next []byte, err error) {
+	tx, err := db.begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
+		return nil, nil
+	}
+	bkId, bkIndex, l := bkNs.Bucket(idBucket), bkNs.Bucket(indexBucket), namespaceKeyLayout(bkNs)
+
+	var c *bbolt.Cursor
+	var k, v []byte
+	step := (*bbolt.Cursor).Next
+	switch order {
+	case ByID:
+		c = bkId.Cursor()
+	case ByIndex:
+		c = bkIndex.Cursor()
+	case ByScore:
+		bk := bkNs.Bucket(runeBucket(0))
+		if bk == nil {
+			return nil, nil
+		}
+		c, step = bk.Cursor(), (*bbolt.Cursor).Prev
+	default:
+		return nil, fmt.Errorf("invalid order %d", order)
+	}
+
+	if len(start) == 0 {
+		if order == ByScore {
+			k, v = c.Last()
+		} else {
+			k, v = c.First()
+		}
+	} else if k, v = c.Seek(start); order == ByScore {
+		if len(k) == 0 {
+			k, v = c.Last()
+		} else if bytes.Compare(k, start) > 0 {
+			k, v = c.Prev()
+		}
+	}
+
+	for ; len(k) > 0; k, v = step(c) {
+		doc := Document{db: db}
+		switch order {
+		case ByID:
+			doc.ID = k
+			doc.Index, doc.Score64, doc.Secondary, _ = l.payloadHeader(v)
+		case ByIndex:
+			doc.ID = v
+			doc.Index, doc.Score64, doc.Secondary, _ = l.payloadHeader(bkId.Get(v))
+		case ByScore:
+			var indexKey []byte
+			doc.Score64, doc.Secondary, doc.Index, indexKey = l.parseKey(k)
+			doc.ID = bkIndex.Get(indexKey)
+		}
+		doc.Score = score32(doc.Score64)
+		doc.ID = append([]byte(nil), doc.ID...)
+		if !f(doc) {
+			k, _ = step(c)
+			break
+		}
+	}
+	if len(k) == 0 {
+		return nil, nil
+	}
+	return append([]byte(nil), k...), nil
+}
+
+// deleteTx removes postings of document id8, or moves them to a new score and
+// secondary key if action is "rescore".
+func deleteTx(bkNs *bbolt.Bucket, l keyLayout, id8 []byte, action string, score, secondary uint64) (*bbolt.Bucket, uint64) {
+	bkId := bkNs.Bucket(idBucket)
+	bkIndex := bkNs.Bucket(indexBucket)
+	bkContent := bkNs.Bucket(contentBucket)
 
 	var tmp []byte
 	var deletes int
-	var oldScore []byte
+	var oldKey, newKey []byte
 	var index uint64
 
 	oldPayload := bkId.Get(id8)
@@ -225,8 +430,11 @@ func deleteTx(tx *bbolt.Tx, ns string, id8 []byte, action string, rescore uint32
 	if len(oldPayload) > 0 {
 		var w int
 		index, w = SortedUvarint(oldPayload)
-		oldScore = oldPayload[w : w+4 : w+4]
-		oldPayload = oldPayload[w+4:]
+		oldKey = AppendSortedUvarint(append([]byte(nil), oldPayload[w:w+l.prefixLen()]...), index)
+		oldPayload = oldPayload[w+l.prefixLen():]
+		if action == "rescore" {
+			newKey = l.postingKey(score, secondary, index)
+		}
 	} else {
 		if action == "delete" || action == "rescore" {
 			return nil, 0
@@ -248,15 +456,16 @@ func deleteTx(tx *bbolt.Tx, ns string, id8 []byte, action string, rescore uint32
 		}
 	}
 
-	foreachPayload(true, oldPayload, func(v uint32) {
-		tmp = binary.BigEndian.AppendUint32(append(tmp[:0], ns...), v)
-		bk := tx.Bucket(tmp)
+	// Payload includes char 0 already.
+	foreachPayload(false, oldPayload, func(v uint32) {
+		tmp = binary.BigEndian.AppendUint32(tmp[:0], v)
+		bk := bkNs.Bucket(tmp)
 		if action == "rescore" {
-			prev, _ := bk.TestDelete(AppendSortedUvarint(oldScore, index))
-			bk.Put(AppendSortedUvarint(binary.BigEndian.AppendUint32(nil, rescore), index), prev)
+			prev, _ := bk.TestDelete(oldKey)
+			bk.Put(newKey, prev)
 		} else {
 			bk.SetSequence(bk.Sequence() - 1)
-			bk.Delete(AppendSortedUvarint(oldScore, index))
+			bk.Delete(oldKey)
 		}
 		deletes++
 	})
@@ -265,14 +474,52 @@ func deleteTx(tx *bbolt.Tx, ns string, id8 []byte, action string, rescore uint32
 		old := bkId.Get(id8)
 		index, w := SortedUvarint(old)
 		buf := AppendSortedUvarint(nil, index)
-		buf = binary.BigEndian.AppendUint32(buf, rescore)
-		buf = append(buf, old[w+4:]...)
+		buf = l.appendScore(buf, score, secondary)
+		buf = append(buf, old[w+l.prefixLen():]...)
 		bkId.Put(id8, buf)
 	}
 
 	return bkId, index
 }
 
+func (l keyLayout) encodePayload(index, score, secondary uint64, chars map[rune][]byte) (payload []byte, err error) {
+	var runes1 []uint16
+	var runes2 []uint32
+	for k := range chars {
+		if k := uint32(k); k < 0xFFFF {
+			runes1 = append(runes1, uint16(k))
+		} else {
+			runes2 = append(runes2, k)
+		}
+	}
+
+	payload = AppendSortedUvarint(nil, index)
+	payload = l.appendScore(payload, score, secondary)
+
+	buf1 := array16.Compress(runes1)
+	payload = binary.AppendUvarint(payload, uint64(len(buf1)))
+	payload = append(payload, buf1...)
+	payload = binary.AppendUvarint(payload, uint64(len(runes2)))
+	for _, k := range runes2 {
+		k -= 0x10000
+		if k > 0xFFFFFF {
+			err = fmt.Errorf("invalid unicode %x", k+0x10000)
+			continue
+		}
+		payload = append(payload, byte(k>>16), byte(k>>8), byte(k))
+	}
+	return payload, err
+}
+
+func (l keyLayout) payloadHeader(payload []byte) (index, score, secondary uint64, rest []byte) {
+	index, w := SortedUvarint(payload)
+	if w <= 0 || len(payload) < w+l.prefixLen() {
+		return 0, 0, 0, nil
+	}
+	score, secondary = l.readScore(payload[w:])
+	return index, score, secondary, payload[w+l.prefixLen():]
+}
+
 func foreachPayload(zero bool, buf []byte, work func(uint32)) {
 	if len(buf) == 0 {
 		return
@@ -301,36 +548,42 @@ func foreachPayload(zero bool, buf []byte, work func(uint32)) {
 }
 
 func (db *DB) Count() (total int, watermark int, err error) {
-	tx, err := db.Store.Begin(false)
+	tx, err := db.begin(false)
 	if err != nil {
 		return 0, 0, err
 	}
 	defer tx.Rollback()
 
-	bkId := tx.Bucket([]byte(db.Namespace))
-	bkIndex := tx.Bucket([]byte(db.Namespace + "index"))
-	if bkIndex != nil {
-		return int(bkIndex.Sequence()), int(bkId.Sequence()), nil
+	if bkNs := db.namespace(tx); bkNs != nil {
+		return int(bkNs.Bucket(indexBucket).Sequence()), int(bkNs.Bucket(idBucket).Sequence()), nil
 	}
 	return 0, 0, nil
 }
 
-func (db *DB) evict(tx *bbolt.Tx, diff int) {
-	bkIndex, _ := tx.CreateBucketIfNotExists([]byte(db.Namespace + "index"))
+func (db *DB) evict(bkNs *bbolt.Bucket, l keyLayout, diff int) {
+	bkIndex := bkNs.Bucket(indexBucket)
 
 	var toDeletes [][]byte
-	bk := tx.Bucket([]byte(db.Namespace + "\x00\x00\x00\x00"))
+	bk := bkNs.Bucket(runeBucket(0))
+	if bk == nil {
+		return
+	}
 	c := bk.Cursor()
 	k, _ := c.First()
 	for i := 0; i < int(diff) && len(k) > 0; i++ {
-		id := bkIndex.Get(k[4:])
+		id := bkIndex.Get(k[l.prefixLen():])
 		if db.OnEvict != nil {
 			db.OnEvict(id)
 		}
 		toDeletes = append(toDeletes, id)
 		k, _ = c.Next()
 	}
+	shadow, bkShadow := db.shadowTx(bkNs.Tx())
 	for _, d := range toDeletes {
-		deleteTx(tx, db.Namespace, d, "delete", 0)
+		deleteTx(bkNs, l, d, "delete", 0, 0)
+		db.logChange(bkNs, Change{Action: "evict", ID: d})
+		if bkShadow != nil {
+			deleteTx(bkShadow, shadow.config().keyLayout(), d, "delete", 0, 0)
+		}
 	}
 }
@@ -0,0 +1,121 @@
+package like
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrIndexerClosed = errors.New("indexer is closed")
+
+// Indexer coalesces documents submitted from many goroutines into BatchIndex calls.
+// Documents in one batch are applied in submission order within a single transaction,
+// so duplicate IDs and rescores behave exactly as if they were indexed one by one.
+type Indexer struct {
+	db       *DB
+	maxBatch int
+	maxDelay time.Duration
+	queue    chan *pendingDoc
+	depth    atomic.Int64
+	mu       sync.RWMutex
+	closed   bool
+	done     chan struct{}
+}
+
+type pendingDoc struct {
+	doc IndexDocument
+	res chan error
+}
+
+func (db *DB) NewIndexer(maxBatch int, maxDelay time.Duration) *Indexer {
+	if maxBatch <= 0 {
+		maxBatch = 1000
+	}
+	ix := &Indexer{
+		db:       db,
+		maxBatch: maxBatch,
+		maxDelay: maxDelay,
+		queue:    make(chan *pendingDoc, maxBatch),
+		done:     make(chan struct{}),
+	}
+	db.mu.Lock()
+	db.indexers = append(db.indexers, ix)
+	db.mu.Unlock()
+	go ix.loop()
+	return ix
+}
+
+// Index queues doc and returns a channel which receives its indexing result once committed.
+func (ix *Indexer) Index(doc IndexDocument) <-chan error {
+	res := make(chan error, 1)
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if ix.closed {
+		res <- ErrIndexerClosed
+		return res
+	}
+	ix.depth.Add(1)
+	ix.queue <- &pendingDoc{doc: doc, res: res}
+	return res
+}
+
+// QueueLen returns the number of documents submitted but not yet committed.
+func (ix *Indexer) QueueLen() int {
+	return int(ix.depth.Load())
+}
+
+// Close stops accepting documents and waits until all queued ones are committed.
+func (ix *Indexer) Close() {
+	ix.mu.Lock()
+	if !ix.closed {
+		ix.closed = true
+		close(ix.queue)
+	}
+	ix.mu.Unlock()
+	<-ix.done
+
+	db := ix.db
+	db.mu.Lock()
+	for i, x := range db.indexers {
+		if x == ix {
+			db.indexers = append(db.indexers[:i], db.indexers[i+1:]...)
+			break
+		}
+	}
+	db.mu.Unlock()
+}
+
+func (ix *Indexer) loop() {
+	defer close(ix.done)
+
+	var batch []*pendingDoc
+	var docs []IndexDocument
+	for p := range ix.queue {
+		batch = append(batch[:0], p)
+		timeout := time.After(ix.maxDelay)
+	COLLECT:
+		for len(batch) < ix.maxBatch {
+			select {
+			case p, ok := <-ix.queue:
+				if !ok {
+					break COLLECT
+				}
+				batch = append(batch, p)
+			case <-timeout:
+				break COLLECT
+			}
+		}
+
+		docs = docs[:0]
+		for _, p := range batch {
+			docs = append(docs, p.doc)
+		}
+		errs := ix.db.BatchIndex(docs, false)
+		for i, p := range batch {
+			p.res <- errs[i]
+		}
+		ix.depth.Add(-int64(len(batch)))
+	}
+}
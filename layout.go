@@ -0,0 +1,388 @@
+package like
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/coyove/bbolt"
+)
+
+// Store layout:
+//
+//	"\x00like"                 root bucket
+//	  "version"                format version
+//	  "aliases"                namespace => namespace it has been switched to by Reindex
+//	  "namespaces"
+//	    <namespace>
+//	      "config"             nsConfig in JSON
+//	      "id"                 document ID => payload
+//	      "index"              document index => document ID
+//	      "content"            document ID => codec ID + encoded content
+//	      "percolate"          query name => query
+//	      "changes"            sequence number => change
+//	      <4-byte rune>        score + secondary key + document index => positions
+//
+// Rune buckets always start with a zero byte, so they never collide with named ones.
+// Widths of scores and secondary keys are recorded per namespace, see keyLayout.
+//
+// Format versions:
+//
+//	1: nested namespace buckets
+//	2: contents are prefixed with their codec ID
+const formatVersion = 2
+
+var (
+	rootBucket       = []byte("\x00like")
+	namespacesBucket = []byte("namespaces")
+	aliasesBucket    = []byte("aliases")
+	versionKey       = []byte("version")
+	configKey        = []byte("config")
+
+	idBucket        = []byte("id")
+	indexBucket     = []byte("index")
+	contentBucket   = []byte("content")
+	percolateBucket = []byte("percolate")
+	changesBucket   = []byte("changes")
+)
+
+var ErrLegacyLayout = errors.New("store uses a legacy layout, open it with Options.Migrate to upgrade")
+
+func runeBucket(r uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, r)
+}
+
+// keyLayout is the encoding of posting keys in a namespace: big-endian score of
+// scoreLen bytes, big-endian secondary key of secondaryLen bytes (possibly none),
+// then the sorted uvarint document index. Payloads store the same score bytes after
+// the document index. 4-byte scores without secondary keys predate keyLayout.
+type keyLayout struct {
+	scoreLen, secondaryLen int
+}
+
+func (l keyLayout) prefixLen() int {
+	return l.scoreLen + l.secondaryLen
+}
+
+func (l keyLayout) maxScore() uint64 {
+	return math.MaxUint64 >> (64 - 8*l.scoreLen)
+}
+
+func (l keyLayout) check(score, secondary uint64) error {
+	if l.scoreLen == 4 && score > math.MaxUint32 {
+		return fmt.Errorf("score %d overflows 32 bits", score)
+	}
+	if l.secondaryLen == 0 && secondary != 0 {
+		return fmt.Errorf("secondary key is not enabled")
+	}
+	if l.secondaryLen == 4 && secondary > math.MaxUint32 {
+		return fmt.Errorf("secondary key %d overflows 32 bits", secondary)
+	}
+	return nil
+}
+
+func (l keyLayout) appendScore(buf []byte, score, secondary uint64) []byte {
+	return appendBigEndian(appendBigEndian(buf, score, l.scoreLen), secondary, l.secondaryLen)
+}
+
+func (l keyLayout) readScore(buf []byte) (score, secondary uint64) {
+	return readBigEndian(buf, l.scoreLen), readBigEndian(buf[l.scoreLen:], l.secondaryLen)
+}
+
+func (l keyLayout) postingKey(score, secondary, index uint64) []byte {
+	return AppendSortedUvarint(l.appendScore(nil, score, secondary), index)
+}
+
+// parseKey splits posting key k, indexKey is the key of the document in the index bucket.
+func (l keyLayout) parseKey(k []byte) (score, secondary, index uint64, indexKey []byte) {
+	score, secondary = l.readScore(k)
+	indexKey = k[l.prefixLen():]
+	index, _ = SortedUvarint(indexKey)
+	return
+}
+
+func appendBigEndian(buf []byte, v uint64, n int) []byte {
+	switch n {
+	case 4:
+		return binary.BigEndian.AppendUint32(buf, uint32(v))
+	case 8:
+		return binary.BigEndian.AppendUint64(buf, v)
+	}
+	return buf
+}
+
+func readBigEndian(buf []byte, n int) uint64 {
+	switch n {
+	case 4:
+		return uint64(binary.BigEndian.Uint32(buf))
+	case 8:
+		return binary.BigEndian.Uint64(buf)
+	}
+	return 0
+}
+
+// score32 caps score to fit the uint32 Score fields.
+func score32(score uint64) uint32 {
+	if score > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(score)
+}
+
+func namespaces(tx *bbolt.Tx) *bbolt.Bucket {
+	if root := tx.Bucket(rootBucket); root != nil {
+		return root.Bucket(namespacesBucket)
+	}
+	return nil
+}
+
+func getNamespace(tx *bbolt.Tx, ns string) *bbolt.Bucket {
+	if nss := namespaces(tx); nss != nil && ns != "" {
+		return nss.Bucket(resolveNamespace(tx, ns))
+	}
+	return nil
+}
+
+func resolveNamespace(tx *bbolt.Tx, ns string) []byte {
+	if root := tx.Bucket(rootBucket); root != nil {
+		if aliases := root.Bucket(aliasesBucket); aliases != nil {
+			if target := aliases.Get([]byte(ns)); target != nil {
+				return target
+			}
+		}
+	}
+	return []byte(ns)
+}
+
+// deleteNamespace deletes ns, if ns is an alias, both the alias and its target are deleted.
+// Other aliases of the target are deleted as well.
+func deleteNamespace(tx *bbolt.Tx, ns string) error {
+	name := append([]byte(nil), resolveNamespace(tx, ns)...)
+	if string(name) != ns {
+		if err := tx.Bucket(rootBucket).Bucket(aliasesBucket).Delete([]byte(ns)); err != nil {
+			return err
+		}
+	}
+	if err := namespaces(tx).DeleteBucket(name); err != nil {
+		return err
+	}
+	return retargetAliases(tx, name, nil)
+}
+
+// switchNamespace deletes ns and points its aliases to 'to', if ns is an alias, ns is
+// pointed to 'to' as well.
+func switchNamespace(tx *bbolt.Tx, ns string, to []byte) error {
+	name := append([]byte(nil), resolveNamespace(tx, ns)...)
+	if err := retargetAliases(tx, name, to); err != nil {
+		return err
+	}
+	return namespaces(tx).DeleteBucket(name)
+}
+
+// retargetAliases points all aliases of namespace 'from' to 'to', or deletes them if
+// 'to' is nil.
+func retargetAliases(tx *bbolt.Tx, from, to []byte) error {
+	aliases := tx.Bucket(rootBucket).Bucket(aliasesBucket)
+	if aliases == nil {
+		return nil
+	}
+	var names [][]byte
+	aliases.ForEach(func(k, v []byte) error {
+		if bytes.Equal(v, from) {
+			names = append(names, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for _, k := range names {
+		var err error
+		if to == nil {
+			err = aliases.Delete(k)
+		} else {
+			err = aliases.Put(k, to)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) namespace(tx *bbolt.Tx) *bbolt.Bucket {
+	return getNamespace(tx, db.Namespace)
+}
+
+func (db *DB) createNamespace(tx *bbolt.Tx, ns string) (*bbolt.Bucket, error) {
+	if bk := getNamespace(tx, ns); bk != nil {
+		return bk, nil
+	}
+	if ns == "" {
+		return nil, fmt.Errorf("empty namespace")
+	}
+
+	root, err := createRoot(tx)
+	if err != nil {
+		return nil, err
+	}
+	nss, err := root.CreateBucketIfNotExists(namespacesBucket)
+	if err != nil {
+		return nil, err
+	}
+	bk, err := nss.CreateBucket([]byte(ns))
+	if err != nil {
+		return nil, err
+	}
+	if err := bk.Put(configKey, db.config().marshal()); err != nil {
+		return nil, err
+	}
+	for _, name := range [][]byte{idBucket, indexBucket, contentBucket} {
+		if _, err := bk.CreateBucket(name); err != nil {
+			return nil, err
+		}
+	}
+	return bk, nil
+}
+
+func createRoot(tx *bbolt.Tx) (*bbolt.Bucket, error) {
+	root, err := tx.CreateBucketIfNotExists(rootBucket)
+	if err != nil {
+		return nil, err
+	}
+	if root.Get(versionKey) == nil {
+		err = root.Put(versionKey, binary.AppendUvarint(nil, formatVersion))
+	}
+	return root, err
+}
+
+func checkLayout(tx *bbolt.Tx) error {
+	if root := tx.Bucket(rootBucket); root != nil {
+		if v, _ := binary.Uvarint(root.Get(versionKey)); v > formatVersion {
+			return fmt.Errorf("unsupported format version %d", v)
+		} else if v < formatVersion {
+			return ErrLegacyLayout
+		}
+		return nil
+	}
+	if len(legacyNamespaces(tx)) > 0 {
+		return ErrLegacyLayout
+	}
+	return nil
+}
+
+// migrate moves every namespace stored in the legacy layout, where bucket names were
+// built by concatenating the namespace with a suffix, into the nested layout, then
+// upgrades namespaces written by older format versions.
+// Each namespace is migrated in its own transaction.
+func (db *DB) migrate() error {
+	for {
+		tx, err := db.begin(true)
+		if err != nil {
+			return err
+		}
+		if _, err := createRoot(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		ns, upgrade := "", false
+		if legacy := legacyNamespaces(tx); len(legacy) > 0 {
+			ns = legacy[0]
+			err = db.migrateNamespace(tx, ns)
+		} else if nss := namespaces(tx); nss != nil {
+			nss.ForEachBucket(func(k []byte) error {
+				if c, _ := readConfig(nss.Bucket(k)); c.Version < formatVersion && ns == "" {
+					ns, upgrade = string(k), true
+				}
+				return nil
+			})
+			if upgrade {
+				err = upgradeNamespace(nss.Bucket([]byte(ns)))
+			}
+		}
+		if ns == "" {
+			err = tx.Bucket(rootBucket).Put(versionKey, binary.AppendUvarint(nil, formatVersion))
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			return tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate namespace %q: %v", ns, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+// upgradeNamespace upgrades a namespace written by an older format version.
+func upgradeNamespace(bkNs *bbolt.Bucket) error {
+	c, err := readConfig(bkNs)
+	if err != nil {
+		return err
+	}
+	if c.Version < 2 {
+		if err := upgradeContents(bkNs.Bucket(contentBucket)); err != nil {
+			return err
+		}
+	}
+	c.Version = formatVersion
+	return bkNs.Put(configKey, c.marshal())
+}
+
+// upgradeContents prefixes raw SCSU contents with the ID of SCSUCodec. Values are
+// collected first since a bucket can't be modified while iterated, all writes stay
+// dirty in the transaction until it commits anyway.
+func upgradeContents(bk *bbolt.Bucket) error {
+	var keys, values [][]byte
+	bk.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		values = append(values, append([]byte{SCSUCodec.ID()}, v...))
+		return nil
+	})
+	for i := range keys {
+		if err := bk.Put(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) migrateNamespace(tx *bbolt.Tx, ns string) error {
+	names, err := legacyBuckets(tx, ns)
+	if err != nil {
+		return err
+	}
+	bkNs, err := db.createNamespace(tx, ns)
+	if err != nil {
+		return err
+	}
+	// Legacy namespaces are of the first format version, upgraded later by migrate,
+	// and always have 32-bit scores and no secondary keys.
+	c := db.config()
+	c.Version = 1
+	c.ScoreBits, c.SecondaryBits = 32, 0
+	if err := bkNs.Put(configKey, c.marshal()); err != nil {
+		return err
+	}
+	for _, name := range names {
+		target := name[len(ns):]
+		if len(target) == 0 {
+			target = idBucket
+		}
+		dst, err := bkNs.CreateBucketIfNotExists(target)
+		if err != nil {
+			return err
+		}
+		if err := copyBucket(dst, tx.Bucket(name)); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
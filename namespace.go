@@ -0,0 +1,184 @@
+package like
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/coyove/bbolt"
+)
+
+var legacySuffixes = []string{"index", "content", "percolate", "changes"}
+
+// ListNamespaces returns names of all namespaces, including aliases created by Reindex.
+// An alias and the namespace it points to are both listed.
+func (db *DB) ListNamespaces() (res []string, err error) {
+	tx, err := db.begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if nss := namespaces(tx); nss != nil {
+		nss.ForEachBucket(func(k []byte) error {
+			res = append(res, string(k))
+			return nil
+		})
+	}
+	if root := tx.Bucket(rootBucket); root != nil && root.Bucket(aliasesBucket) != nil {
+		root.Bucket(aliasesBucket).ForEach(func(k, _ []byte) error {
+			res = append(res, string(k))
+			return nil
+		})
+		sort.Strings(res)
+	}
+	return res, nil
+}
+
+// DropNamespace deletes ns. If ns is an alias, its target is deleted too, aliases of a
+// deleted namespace are removed.
+func (db *DB) DropNamespace(ns string) error {
+	tx, err := db.begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if getNamespace(tx, ns) == nil {
+		return nil
+	}
+	if err := deleteNamespace(tx, ns); err != nil {
+		return err
+	}
+	tx.OnCommit(db.resetPercolator)
+	return tx.Commit()
+}
+
+func (db *DB) CopyNamespace(from, to string) error {
+	return db.copyNamespace(from, to, false)
+}
+
+// RenameNamespace moves namespace 'from' to 'to', aliases of 'from' are updated to 'to'.
+func (db *DB) RenameNamespace(from, to string) error {
+	return db.copyNamespace(from, to, true)
+}
+
+func (db *DB) copyNamespace(from, to string, move bool) error {
+	if from == to {
+		return fmt.Errorf("same namespace %q", from)
+	}
+	if to == "" {
+		return fmt.Errorf("empty namespace")
+	}
+
+	tx, err := db.begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	src := getNamespace(tx, from)
+	if src == nil {
+		return fmt.Errorf("namespace %q not found", from)
+	}
+	if getNamespace(tx, to) != nil {
+		return fmt.Errorf("namespace %q already exists", to)
+	}
+	dst, err := namespaces(tx).CreateBucket([]byte(to))
+	if err != nil {
+		return err
+	}
+	if err := copyBucket(dst, src); err != nil {
+		return err
+	}
+	if move {
+		isAlias := string(resolveNamespace(tx, from)) != from
+		if err := switchNamespace(tx, from, []byte(to)); err != nil {
+			return err
+		}
+		if isAlias {
+			if err := tx.Bucket(rootBucket).Bucket(aliasesBucket).Delete([]byte(from)); err != nil {
+				return err
+			}
+		}
+	}
+	tx.OnCommit(db.resetPercolator)
+	return tx.Commit()
+}
+
+// legacyNamespaces returns all namespaces stored in the legacy layout. A namespace is
+// recognized by its ID bucket (named after the namespace) and its index bucket.
+func legacyNamespaces(tx *bbolt.Tx) (res []string) {
+	tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+		if tx.Bucket(append(name[:len(name):len(name)], "index"...)) != nil {
+			res = append(res, string(name))
+		}
+		return nil
+	})
+	sort.Strings(res)
+	return res
+}
+
+// legacyBuckets returns names of all legacy buckets belonging to ns. Buckets whose
+// names can be derived from more than one namespace belong to the longest one, if
+// that is not possible (e.g. ID bucket of "fooindex" is also the index bucket of
+// "foo") an error is returned.
+func legacyBuckets(tx *bbolt.Tx, ns string) (names [][]byte, err error) {
+	all := legacyNamespaces(tx)
+	derived := func(name []byte, ns string) bool {
+		if !bytes.HasPrefix(name, []byte(ns)) {
+			return false
+		}
+		suffix := name[len(ns):]
+		if len(suffix) == 0 {
+			return true
+		}
+		if len(suffix) == 4 && suffix[0] == 0 {
+			return true
+		}
+		for _, s := range legacySuffixes {
+			if string(suffix) == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	err = tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+		if !derived(name, ns) {
+			return nil
+		}
+		for _, other := range all {
+			if other == ns || !derived(name, other) {
+				continue
+			}
+			if string(name) == other {
+				return fmt.Errorf("namespace %q overlaps with namespace %q", ns, other)
+			}
+			if len(other) > len(ns) {
+				return nil
+			}
+		}
+		names = append(names, append([]byte(nil), name...))
+		return nil
+	})
+	return names, err
+}
+
+func copyBucket(dst, src *bbolt.Bucket) error {
+	dst.FillPercent = 0.9
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			// v points into the mmap which may be remapped before commit.
+			return dst.Put(k, append([]byte(nil), v...))
+		}
+		sub, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(sub, src.Bucket(k))
+	})
+}
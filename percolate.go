@@ -0,0 +1,176 @@
+package like
+
+import (
+	"fmt"
+	"sort"
+)
+
+type savedQuery struct {
+	name    string
+	chars   []*segchars
+	charsEx []*segchars
+}
+
+type percolator struct {
+	ns     string
+	byChar map[rune][]*savedQuery
+	any    []*savedQuery
+}
+
+func (db *DB) RegisterQuery(name, query string) error {
+	if name == "" {
+		return fmt.Errorf("empty query name")
+	}
+	if chars, charsEx := db.parseQuery(query, db.maxChars(), &Metrics{}); len(chars) == 0 && len(charsEx) == 0 {
+		return fmt.Errorf("empty query")
+	}
+
+	tx, err := db.begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bkNs, err := db.createNamespace(tx, db.Namespace)
+	if err != nil {
+		return err
+	}
+	bk, _ := bkNs.CreateBucketIfNotExists(percolateBucket)
+	if err := bk.Put([]byte(name), []byte(query)); err != nil {
+		return err
+	}
+	tx.OnCommit(db.resetPercolator)
+	return tx.Commit()
+}
+
+func (db *DB) UnregisterQuery(name string) error {
+	tx, err := db.begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if bkNs := db.namespace(tx); bkNs != nil && bkNs.Bucket(percolateBucket) != nil {
+		bkNs.Bucket(percolateBucket).Delete([]byte(name))
+	}
+	tx.OnCommit(db.resetPercolator)
+	return tx.Commit()
+}
+
+func (db *DB) Queries() (res map[string]string, err error) {
+	tx, err := db.begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res = map[string]string{}
+	if bkNs := db.namespace(tx); bkNs != nil && bkNs.Bucket(percolateBucket) != nil {
+		bkNs.Bucket(percolateBucket).ForEach(func(k, v []byte) error {
+			res[string(k)] = string(v)
+			return nil
+		})
+	}
+	return res, nil
+}
+
+func (db *DB) Percolate(doc IndexDocument) ([]string, error) {
+	chars, _ := Collect(doc.Content, db.maxChars())
+	return db.percolate(chars)
+}
+
+func (db *DB) percolate(chars map[rune][]byte) (names []string, err error) {
+	p, err := db.loadPercolator()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[*savedQuery]bool{}
+	check := func(q *savedQuery) {
+		if seen[q] {
+			return
+		}
+		seen[q] = true
+		if q.match(chars) {
+			names = append(names, q.name)
+		}
+	}
+	for _, q := range p.any {
+		check(q)
+	}
+	for r := range chars {
+		for _, q := range p.byChar[r] {
+			check(q)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (db *DB) resetPercolator() {
+	db.mu.Lock()
+	db.percolator = nil
+	db.mu.Unlock()
+}
+
+func (db *DB) loadPercolator() (*percolator, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.percolator != nil && db.percolator.ns == db.Namespace {
+		return db.percolator, nil
+	}
+
+	queries, err := db.Queries()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &percolator{ns: db.Namespace, byChar: map[rune][]*savedQuery{}}
+	for name, query := range queries {
+		q := &savedQuery{name: name}
+		q.chars, q.charsEx = db.parseQuery(query, db.maxChars(), &Metrics{})
+
+		// All terms must appear in the document, so any one of their chars can be used to
+		// pre-filter the query, trigrams (which are hashed above 0xF0000) are the most selective.
+		var key rune
+		for _, sc := range q.chars {
+			for _, r := range sc.Chars {
+				if r > key {
+					key = r
+				}
+			}
+		}
+		if key == 0 {
+			p.any = append(p.any, q)
+		} else {
+			p.byChar[key] = append(p.byChar[key], q)
+		}
+	}
+	db.percolator = p
+	return p, nil
+}
+
+func (q *savedQuery) match(chars map[rune][]byte) bool {
+	m := &Metrics{}
+	test := func(sc *segchars) bool {
+		values := make([][]byte, len(sc.Chars))
+		for i, r := range sc.Chars {
+			if values[i] = chars[r]; len(values[i]) == 0 {
+				return false
+			}
+		}
+		_, ok := sc.match(values, m)
+		return ok
+	}
+	for _, sc := range q.chars {
+		if !test(sc) {
+			return false
+		}
+	}
+	for _, sc := range q.charsEx {
+		if test(sc) {
+			return false
+		}
+	}
+	return true
+}
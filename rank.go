@@ -0,0 +1,65 @@
+package like
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/coyove/bbolt"
+)
+
+const defaultRankWindow = 1000
+
+// rankSearch takes the first Metrics.RankWindow matches in walking order and returns
+// the top n of them by Metrics.Rank, ties keep walking order.
+func (db *DB) rankSearch(tx *bbolt.Tx, query string, start []byte, n int, metrics *Metrics) []Document {
+	window := metrics.RankWindow
+	if window <= 0 {
+		window = defaultRankWindow
+	}
+	if window < n {
+		window = n
+	}
+	// Search with a copy of metrics without Rank, so the caller's one is never altered
+	// even if the search panics.
+	rank, m := metrics.Rank, *metrics
+	m.Rank = nil
+	res, _ := db.search(tx, query, start, window, &m)
+	m.Rank = rank
+	*metrics = m
+
+	ranks := make([]float64, len(res))
+	for i, d := range res {
+		ranks[i] = rank(d)
+	}
+	sort.Stable(&byRank{res, ranks})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+type byRank struct {
+	docs  []Document
+	ranks []float64
+}
+
+func (r *byRank) Len() int { return len(r.docs) }
+
+func (r *byRank) Less(i, j int) bool { return r.ranks[i] > r.ranks[j] }
+
+func (r *byRank) Swap(i, j int) {
+	r.docs[i], r.docs[j] = r.docs[j], r.docs[i]
+	r.ranks[i], r.ranks[j] = r.ranks[j], r.ranks[i]
+}
+
+// Decay returns 0.5^(age/halfLife), where age is the time from Unix seconds ts to now,
+// for Metrics.Rank to favor recent documents, e.g. float64(d.Score64) * Decay(d.Secondary,
+// now, 24*time.Hour). Timestamps after now are not decayed.
+func Decay(ts uint64, now time.Time, halfLife time.Duration) float64 {
+	age := now.Sub(time.Unix(int64(ts), 0))
+	if age <= 0 || halfLife <= 0 {
+		return 1
+	}
+	return math.Exp2(-float64(age) / float64(halfLife))
+}
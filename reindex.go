@@ -0,0 +1,166 @@
+package like
+
+import (
+	"fmt"
+
+	"github.com/coyove/bbolt"
+)
+
+type ReindexOptions struct {
+	MaxChars uint16
+	// ScoreBits and SecondaryBits of the new namespace, db's settings if zero.
+	// Set SecondaryBits to -1 to disable secondary keys.
+	ScoreBits     int
+	SecondaryBits int
+	BatchSize     int
+	OnProgress    func(copied int)
+}
+
+type reindexState struct {
+	from   string
+	shadow *DB
+}
+
+// Reindex rebuilds namespace 'from' into a new namespace 'to' using the settings in opts,
+// while 'from' stays searchable. Writes made through db to 'from' during the rebuild are
+// applied to both namespaces in the same transaction. When all documents are copied,
+// 'from' becomes an alias of 'to' and its old buckets are dropped in one transaction,
+// so readers switch atomically, db.MaxChars, db.ScoreBits and db.SecondaryBits are
+// updated accordingly. Other aliases of 'from' are switched to 'to' as well.
+//
+// Documents keep their IDs and scores, but are renumbered in 'to', so indexes
+// returned by GetIndexAndScore before the switch are no longer valid.
+func (db *DB) Reindex(from, to string, opts ReindexOptions) error {
+	if from == to {
+		return fmt.Errorf("same namespace %q", from)
+	}
+	return db.reindexTo(from, to, opts, false)
+}
+
+// reindexTo implements Reindex, a leftover namespace 'to' is dropped first if replace
+// is true.
+func (db *DB) reindexTo(from, to string, opts ReindexOptions, replace bool) error {
+	if opts.MaxChars == 0 {
+		opts.MaxChars = db.maxChars()
+	}
+	cfg := db.config()
+	if opts.ScoreBits == 0 {
+		opts.ScoreBits = cfg.ScoreBits
+	}
+	switch opts.SecondaryBits {
+	case 0:
+		opts.SecondaryBits = cfg.SecondaryBits
+	case -1:
+		opts.SecondaryBits = 0
+	}
+	if err := checkKeyBits(opts.ScoreBits, opts.SecondaryBits); err != nil {
+		return err
+	}
+	shadow := &DB{Namespace: to, MaxChars: opts.MaxChars, IndexOnly: db.IndexOnly,
+		ContentProvider: db.ContentProvider, ContentCodec: db.ContentCodec,
+		ScoreBits: opts.ScoreBits, SecondaryBits: opts.SecondaryBits}
+
+	tx, err := db.begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { tx.Rollback() }()
+
+	// Registered while holding the writer lock, so every write committed after this
+	// transaction is dual-applied, and every write before it is seen by copyDocuments.
+	db.mu.Lock()
+	if db.reindex != nil {
+		db.mu.Unlock()
+		return fmt.Errorf("namespace %q is being reindexed", db.reindex.from)
+	}
+	db.reindex = &reindexState{from: from, shadow: shadow}
+	db.mu.Unlock()
+
+	defer func() {
+		db.mu.Lock()
+		db.reindex = nil
+		db.mu.Unlock()
+	}()
+
+	if getNamespace(tx, from) == nil {
+		return fmt.Errorf("namespace %q not found", from)
+	}
+	if getNamespace(tx, to) != nil {
+		if !replace {
+			return fmt.Errorf("namespace %q already exists", to)
+		}
+		if err := deleteNamespace(tx, to); err != nil {
+			return err
+		}
+	}
+	if _, err := shadow.createNamespace(tx, to); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := db.copyDocuments(shadow, from, opts.BatchSize, opts.OnProgress); err != nil {
+		db.DropNamespace(to)
+		return err
+	}
+
+	if tx, err = db.begin(true); err != nil {
+		return err
+	}
+	src, dst := getNamespace(tx, from), getNamespace(tx, to)
+	for _, name := range [][]byte{percolateBucket, changesBucket} {
+		dst.DeleteBucket(name)
+		if b := src.Bucket(name); b != nil {
+			d, _ := dst.CreateBucket(name)
+			if err := copyBucket(d, b); err != nil {
+				return err
+			}
+		}
+	}
+	if err := switchNamespace(tx, from, []byte(to)); err != nil {
+		return err
+	}
+	aliases, err := tx.Bucket(rootBucket).CreateBucketIfNotExists(aliasesBucket)
+	if err != nil {
+		return err
+	}
+	if err := aliases.Put([]byte(from), []byte(to)); err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		db.cfgMu.Lock()
+		db.MaxChars = opts.MaxChars
+		db.ScoreBits, db.SecondaryBits = opts.ScoreBits, opts.SecondaryBits
+		db.cfgMu.Unlock()
+		db.resetPercolator()
+	})
+
+	// Other transactions may see 'to' before the handler above runs, or 'from' after it.
+	db.cfgMu.Lock()
+	last := db.cfgSwitch
+	db.cfgSwitch = &cfgSwitch{tx: tx.ID(), prev: cfg, next: shadow.config()}
+	db.cfgMu.Unlock()
+	if err := tx.Commit(); err != nil {
+		db.cfgMu.Lock()
+		db.cfgSwitch = last
+		db.cfgMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// shadowTx returns the reindex target of db's namespace, writes to the namespace
+// should be applied to it as well.
+func (db *DB) shadowTx(tx *bbolt.Tx) (*DB, *bbolt.Bucket) {
+	db.mu.Lock()
+	r := db.reindex
+	db.mu.Unlock()
+	if r == nil || r.from != db.Namespace || string(resolveNamespace(tx, r.from)) == r.shadow.Namespace {
+		return nil, nil
+	}
+	if bk := getNamespace(tx, r.shadow.Namespace); bk != nil {
+		return r.shadow, bk
+	}
+	return nil, nil
+}
@@ -0,0 +1,111 @@
+package like
+
+import "fmt"
+
+type RescoreMode int
+
+const (
+	// RescoreSet always sets the score and secondary key.
+	RescoreSet RescoreMode = iota
+	// RescoreIfGreater sets them only if the new score is greater than the current one.
+	RescoreIfGreater
+	// RescoreIfOlder sets them only if the current secondary key is less than the new
+	// one, which makes the secondary key a version (e.g. timestamp) of the score so
+	// stale updates are dropped. It requires DB.SecondaryBits.
+	RescoreIfOlder
+	// RescoreIncrement adds Delta to the current score, saturating at 0 and at the
+	// maximum score, the secondary key is kept.
+	RescoreIncrement
+)
+
+type ScoreUpdate struct {
+	ID        []byte
+	Mode      RescoreMode
+	Score     uint64
+	Secondary uint64
+	Delta     int64
+}
+
+// RescoreResult is the outcome of a ScoreUpdate, with the score and secondary key
+// of the document before the update.
+type RescoreResult struct {
+	Found     bool
+	Applied   bool
+	Score     uint64
+	Secondary uint64
+}
+
+// Rescore applies updates in order in one transaction, either all of them are applied
+// or none if an error is returned. Updates of missing documents are skipped.
+func (db *DB) Rescore(updates []ScoreUpdate) ([]RescoreResult, error) {
+	tx, err := db.begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res := make([]RescoreResult, len(updates))
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
+		return res, nil
+	}
+	cfg, err := db.checkConfig(bkNs)
+	if err != nil {
+		return nil, err
+	}
+	shadow, bkShadow := db.shadowTx(tx)
+	bkId, l := bkNs.Bucket(idBucket), cfg.keyLayout()
+	if l.secondaryLen == 0 {
+		for i, u := range updates {
+			if u.Mode == RescoreIfOlder {
+				return nil, fmt.Errorf("update %d: RescoreIfOlder requires secondary keys", i)
+			}
+		}
+	}
+
+	for i, u := range updates {
+		payload := bkId.Get(u.ID)
+		if payload == nil {
+			continue
+		}
+		r := &res[i]
+		_, r.Score, r.Secondary, _ = l.payloadHeader(payload)
+		r.Found = true
+
+		score, secondary := u.Score, u.Secondary
+		switch u.Mode {
+		case RescoreSet:
+			r.Applied = true
+		case RescoreIfGreater:
+			r.Applied = score > r.Score
+		case RescoreIfOlder:
+			r.Applied = r.Secondary < secondary
+		case RescoreIncrement:
+			score, secondary, r.Applied = r.Score, r.Secondary, u.Delta != 0
+			switch d := u.Delta; {
+			case d > 0 && uint64(d) > l.maxScore()-score:
+				score = l.maxScore()
+			case d < 0 && uint64(-d) > score:
+				score = 0
+			default:
+				score += uint64(d)
+			}
+		default:
+			return nil, fmt.Errorf("update %d: invalid mode %d", i, u.Mode)
+		}
+		if !r.Applied {
+			continue
+		}
+
+		if err := db.rescoreTx(bkNs, l, u.ID, score, secondary); err != nil {
+			return nil, fmt.Errorf("update %d: %v", i, err)
+		}
+		if shadow != nil {
+			shadow.rescoreTx(bkShadow, shadow.config().keyLayout(), u.ID, score, secondary)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
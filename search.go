@@ -2,7 +2,7 @@ package like
 
 import (
 	"bytes"
-	"encoding/binary"
+	"sort"
 	"strings"
 	"time"
 	"unicode"
@@ -24,62 +24,41 @@ type cursor struct {
 }
 
 func (db *DB) Search(query string, start []byte, n int, metrics *Metrics) (res []Document, next []byte) {
-	metrics.Query = query
-
-	var chars, charsEx []*segchars
-
-	query = strings.TrimSpace(query)
-	for len(query) > 0 {
-		var exclude bool
-		if query[0] == '-' {
-			exclude = true
-			query = query[1:]
-		}
-
-		var term string
-		var fuzzy bool = true
-		if q := strings.IndexByte(query[1:], '"'); q > -1 && query[0] == '"' {
-			// Quoted term.
-			term, query = query[1:1+q], query[1+q+1:]
-			fuzzy = false
-		} else if i := strings.IndexFunc(query, unicode.IsSpace); i == -1 {
-			// End of query.
-			term, query = query, ""
-		} else {
-			// Normal term.
-			term, query = query[:i], strings.TrimSpace(query[i+1:])
-		}
-
-		parts := metrics.Collect(term, db.MaxChars)
-		if len(parts) == 0 {
-			continue
-		}
-
-		if exclude {
-			s := &segchars{Chars: parts}
-			charsEx = append(charsEx, s)
-			metrics.CharsEx = append(metrics.CharsEx, s)
-		} else {
-			s := &segchars{Chars: parts, Fuzzy: fuzzy}
-			chars = append(chars, s)
-			metrics.Chars = append(metrics.Chars, s)
-		}
+	if metrics == nil {
+		metrics = &Metrics{}
 	}
+	tx, err := db.begin(false)
+	if err != nil {
+		metrics.Error = err.Error()
+		return
+	}
+	defer tx.Rollback()
+	return db.search(tx, query, start, n, metrics)
+}
 
-	if len(chars) == 0 {
-		chars = []*segchars{{Chars: []rune{0}}}
+func (db *DB) search(tx *bbolt.Tx, query string, start []byte, n int, metrics *Metrics) (res []Document, next []byte) {
+	if metrics == nil {
+		metrics = &Metrics{}
+	}
+	metrics.Query = query
+	if metrics.Rank != nil {
+		return db.rankSearch(tx, query, start, n, metrics), nil
 	}
 
-	tx, err := db.Store.Begin(false)
+	bkNs := db.namespace(tx)
+	if bkNs == nil {
+		return
+	}
+	cfg, err := db.checkConfig(bkNs)
 	if err != nil {
 		metrics.Error = err.Error()
 		return
 	}
-	defer tx.Rollback()
+	bkIndex, l := bkNs.Bucket(indexBucket), cfg.keyLayout()
 
-	bkIndex := tx.Bucket([]byte(db.Namespace + "index"))
-	if bkIndex == nil {
-		return
+	chars, charsEx := db.parseQuery(query, cfg.MaxChars, metrics)
+	if len(chars) == 0 {
+		chars = []*segchars{{Chars: []rune{0}}}
 	}
 
 	var ddl int64
@@ -87,25 +66,49 @@ func (db *DB) Search(query string, start []byte, n int, metrics *Metrics) (res [
 		ddl = time.Now().Add(db.SearchTimeout).UnixNano()
 	}
 
+	// A selective ID filter is evaluated by checking postings of its documents only,
+	// otherwise results are filtered after matching.
+	w := metrics.walk(l)
+	lo, hi, idFilter := metrics.idBounds()
+	var candidates [][]byte
+	if idFilter {
+		limit := maxIDCandidates
+		if db.maxIDCandidatesTest > 0 {
+			limit = db.maxIDCandidatesTest
+		}
+		candidates = idCandidates(bkNs, l, lo, hi, limit)
+		metrics.IDCandidates = len(candidates)
+	}
+
 MORE:
-	db.marchSearch(tx, chars, start, metrics, func(key []byte, segs [][2]uint16) bool {
+	search := db.marchSearch
+	if candidates != nil {
+		search = func(bkNs *bbolt.Bucket, l keyLayout, chars []*segchars, start []byte, metrics *Metrics, f func([]byte, [][2]uint16) bool, ddl int64) {
+			candidateSearch(bkNs, l, chars, candidates, start, metrics, f, ddl)
+		}
+	}
+	search(bkNs, l, chars, start, metrics, func(key []byte, segs [][2]uint16) bool {
 		if len(res) >= n {
 			res = res[:n]
 			next = append([]byte(nil), key...)
 			return false
 		}
 
-		indexBuf := key[4:]
-		index, _ := SortedUvarint(indexBuf)
-		score := binary.BigEndian.Uint32(key[:4])
-		docId := bkIndex.Get(indexBuf)
+		score, secondary, index, indexKey := l.parseKey(key)
+		docId := bkIndex.Get(indexKey)
+		if idFilter && candidates == nil && !inRange(docId, lo, hi) {
+			return true
+		}
 
 		doc := Document{
-			Index: index,
-			ID:    append([]byte(nil), docId...),
-			Score: score,
-			Segs:  append([][2]uint16(nil), segs...),
-			db:    db,
+			Index:     index,
+			ID:        append([]byte(nil), docId...),
+			Score:     score32(score),
+			Score64:   score,
+			Secondary: secondary,
+			Segs:      append([][2]uint16(nil), segs...),
+			db:        db,
+			key:       append([]byte(nil), key...),
 		}
 		if metrics.Deduplicator == nil || !metrics.Deduplicator(doc) {
 			res = append(res, doc)
@@ -120,13 +123,12 @@ MORE:
 			if len(res) == 0 {
 				break
 			}
-			boundKey := res[len(res)-1].boundKey(nil)
-			db.marchSearch(tx, charsEx[i:i+1], start, metrics, func(key []byte, _ [][2]uint16) bool {
-				if bytes.Compare(key, boundKey) < 0 {
+			boundKey := res[len(res)-1].key
+			db.marchSearch(bkNs, l, charsEx[i:i+1], start, metrics, func(key []byte, _ [][2]uint16) bool {
+				if w.cmp(key, boundKey) > 0 {
 					return false
 				}
-				indexBuf := key[4:]
-				index, _ := SortedUvarint(indexBuf)
+				_, _, index, _ := l.parseKey(key)
 				for i := range res {
 					if res[i].Index == index {
 						res = append(res[:i], res[i+1:]...)
@@ -152,28 +154,150 @@ MORE:
 	return
 }
 
-func (db *DB) marchSearch(tx *bbolt.Tx, chars []*segchars, start []byte, metrics *Metrics, f func([]byte, [][2]uint16) bool, ddl int64) {
+func (db *DB) parseQuery(query string, maxChars uint16, metrics *Metrics) (chars, charsEx []*segchars) {
+	query = strings.TrimSpace(query)
+	for len(query) > 0 {
+		var exclude bool
+		if query[0] == '-' {
+			exclude = true
+			query = query[1:]
+		}
+
+		var term string
+		var fuzzy bool = true
+		if q := strings.IndexByte(query[1:], '"'); q > -1 && query[0] == '"' {
+			// Quoted term.
+			term, query = query[1:1+q], query[1+q+1:]
+			fuzzy = false
+		} else if i := strings.IndexFunc(query, unicode.IsSpace); i == -1 {
+			// End of query.
+			term, query = query, ""
+		} else {
+			// Normal term.
+			term, query = query[:i], strings.TrimSpace(query[i+1:])
+		}
+
+		parts := metrics.Collect(term, maxChars)
+		if len(parts) == 0 {
+			continue
+		}
+
+		if exclude {
+			s := &segchars{Chars: parts}
+			charsEx = append(charsEx, s)
+			metrics.CharsEx = append(metrics.CharsEx, s)
+		} else {
+			s := &segchars{Chars: parts, Fuzzy: fuzzy}
+			chars = append(chars, s)
+			metrics.Chars = append(metrics.Chars, s)
+		}
+	}
+
+	return
+}
+
+// walk is the direction and score range of a search.
+type walk struct {
+	asc    bool
+	lo, hi []byte // posting key range [lo, hi), nil means unbounded
+}
+
+func (d *Metrics) walk(l keyLayout) (w walk) {
+	w.asc = d.Ascending
+	max := l.maxScore()
+	lo, hi := d.scoreRange()
+	if lo > max {
+		// Empty range.
+		w.lo = appendBigEndian(nil, max, l.scoreLen)
+		w.hi = w.lo
+		return w
+	}
+	if lo > 0 {
+		w.lo = appendBigEndian(nil, lo, l.scoreLen)
+	}
+	if hi > 0 && hi < max {
+		w.hi = appendBigEndian(nil, hi+1, l.scoreLen)
+	}
+	return w
+}
+
+func (d *Metrics) scoreRange() (lo, hi uint64) {
+	lo, hi = uint64(d.MinScore), uint64(d.MaxScore)
+	if d.MinScore64 != 0 {
+		lo = d.MinScore64
+	}
+	if d.MaxScore64 != 0 {
+		hi = d.MaxScore64
+	}
+	return lo, hi
+}
+
+// cmp compares keys in walking order, a < b if a will be visited before b.
+func (w walk) cmp(a, b []byte) int {
+	if w.asc {
+		return bytes.Compare(a, b)
+	}
+	return bytes.Compare(b, a)
+}
+
+func (w walk) within(k []byte) bool {
+	return (w.lo == nil || bytes.Compare(k, w.lo) >= 0) && (w.hi == nil || bytes.Compare(k, w.hi) < 0)
+}
+
+func (w walk) step(c *bbolt.Cursor) ([]byte, []byte) {
+	if w.asc {
+		return c.Next()
+	}
+	return c.Prev()
+}
+
+// seek moves c to the first key not before key in walking order.
+func (w walk) seek(c *bbolt.Cursor, key []byte) ([]byte, []byte) {
+	k, v := c.Seek(key)
+	if w.asc {
+		return k, v
+	}
+	if len(k) == 0 {
+		return c.Last()
+	}
+	if bytes.Compare(k, key) > 0 {
+		return c.Prev()
+	}
+	return k, v
+}
+
+// first moves c to the first key to visit, starting from start (inclusive) if not empty.
+func (w walk) first(c *bbolt.Cursor, start []byte) ([]byte, []byte) {
+	bound := w.hi
+	if w.asc {
+		bound = w.lo
+	}
+	if bound != nil && (len(start) == 0 || w.cmp(start, bound) < 0) {
+		start = bound
+	}
+	switch {
+	case len(start) > 0:
+		return w.seek(c, start)
+	case w.asc:
+		return c.First()
+	default:
+		return c.Last()
+	}
+}
+
+func (db *DB) marchSearch(bkNs *bbolt.Bucket, l keyLayout, chars []*segchars, start []byte, metrics *Metrics, f func([]byte, [][2]uint16) bool, ddl int64) {
 	var cursors []*cursor
+	w := metrics.walk(l)
 
 	for _, sc := range chars {
 		sc.cursors = sc.cursors[:0]
 		for _, r := range sc.Chars {
-			bk := tx.Bucket(binary.BigEndian.AppendUint32([]byte(db.Namespace), uint32(r)))
+			bk := bkNs.Bucket(runeBucket(uint32(r)))
 			if bk == nil {
 				return
 			}
 			c := bk.Cursor()
-			var k, v []byte
-			if len(start) > 0 {
-				k, v = c.Seek(start)
-				if len(k) == 0 {
-					k, v = c.Last()
-				} else if bytes.Compare(k, start) > 0 {
-					k, v = c.Prev()
-				}
-			} else {
-				k, v = c.Last()
-			}
+			k, v := w.first(c, start)
 			cur := &cursor{c, k, v}
 			cursors = append(cursors, cur)
 			sc.cursors = append(sc.cursors, cur)
@@ -182,21 +306,22 @@ func (db *DB) marchSearch(tx *bbolt.Tx, chars []*segchars, start []byte, metrics
 
 	if len(chars) == 1 && len(chars[0].Chars) == 1 && chars[0].Chars[0] == 0 {
 		c := cursors[0]
-		for len(c.key) > 0 {
+		for len(c.key) > 0 && w.within(c.key) {
 			metrics.Scan++
 			if !f(c.key, nil) {
 				return
 			}
-			c.key, c.value = c.Prev()
+			c.key, c.value = w.step(c.Cursor)
 		}
 		return
 	}
 
 	var slowNow int
 	var segs [][2]uint16
+	var values [][]byte
 
 SWITCH_HEAD:
-	for head := cursors[0]; len(head.key) > 0; {
+	for head := cursors[0]; len(head.key) > 0 && w.within(head.key); {
 		if ddl > 0 {
 			slowNow++
 			if slowNow%100 == 0 && time.Now().UnixNano() > ddl {
@@ -206,7 +331,8 @@ SWITCH_HEAD:
 		}
 
 		for _, cur := range cursors {
-			cmp := bytes.Compare(cur.key, head.key)
+			// cmp < 0: cur is ahead of head in walking order.
+			cmp := w.cmp(head.key, cur.key)
 			if cmp == 0 {
 				continue
 			}
@@ -217,38 +343,29 @@ SWITCH_HEAD:
 				continue SWITCH_HEAD
 			}
 
-			// Try fast path to avoid seek
+			// Try fast path to avoid seek, only descending walks have one.
 			var same bool
 		FAST:
-			if cur.key, cur.value, same = cur.PrevSamePage(); same {
-				switch bytes.Compare(cur.key, head.key) {
-				case 1:
-					goto FAST
-				case 0:
-					continue
-				case -1:
-					head = cur
-					metrics.FastSwitchHead++
-					continue SWITCH_HEAD
+			if !w.asc {
+				if cur.key, cur.value, same = cur.PrevSamePage(); same {
+					switch bytes.Compare(cur.key, head.key) {
+					case 1:
+						goto FAST
+					case 0:
+						continue
+					case -1:
+						head = cur
+						metrics.FastSwitchHead++
+						continue SWITCH_HEAD
+					}
 				}
 			}
 			metrics.Seek++
 
-			cur.key, cur.value = cur.Seek(head.key)
-			if len(cur.key) == 0 {
-				cur.key, cur.value = cur.Last()
-			}
-
-			cmp = bytes.Compare(cur.key, head.key)
-			if cmp == 1 {
-				cur.key, cur.value = cur.Prev()
-				if len(cur.key) == 0 {
-					break SWITCH_HEAD
-				}
-				cmp = bytes.Compare(cur.key, head.key)
+			if cur.key, cur.value = w.seek(cur.Cursor, head.key); len(cur.key) == 0 {
+				break SWITCH_HEAD
 			}
-
-			if cmp == 0 {
+			if bytes.Equal(cur.key, head.key) {
 				continue
 			}
 
@@ -262,54 +379,16 @@ SWITCH_HEAD:
 		match := false
 		segs = segs[:0]
 		for _, seg := range chars {
-			cc := seg.cursors
-			missThreshold := metrics.FuzzyMiss
-			dist := metrics.FuzzyDist
-			if missThreshold >= len(cc)/2 {
-				missThreshold = len(cc) / 2
+			values = values[:0]
+			for _, c := range seg.cursors {
+				values = append(values, c.value)
 			}
-			if len(cc) <= 4 {
-				missThreshold = 0
-			}
-			if !seg.Fuzzy {
-				missThreshold = 0
-				dist = 0
-			}
-
-			// fmt.Println(len(cc[0].value), array16.Stringify(cc[0].value))
-
-			array16.Foreach(cc[0].value, func(pos uint16) bool {
-				misses := 0
-				match = false
-				minPos, maxPos := pos, array16.AddSat(pos, uint16(len(cc))-1)
-				for i := 1; i < len(cc); i++ {
-					pos := array16.AddSat(pos, uint16(i))
-					realPos, ok := array16.Contains(cc[i].value, array16.SubSat(pos, dist), array16.AddSat(pos, dist))
-					if !ok {
-						misses++
-						if misses > missThreshold {
-							return true
-						}
-						continue
-					}
-					if realPos > maxPos {
-						maxPos = realPos
-					}
-					if realPos < minPos {
-						minPos = realPos
-					}
-				}
-
-				// Found
-				match = true
-				segs = append(segs, [2]uint16{minPos, maxPos})
-				return false
-			})
-
-			if !match {
+			var span [2]uint16
+			if span, match = seg.match(values, metrics); !match {
 				metrics.Miss++
 				break
 			}
+			segs = append(segs, span)
 		}
 
 		// === NOTE: cursors[*].value has been invalidated, don't use ===
@@ -320,8 +399,144 @@ SWITCH_HEAD:
 			}
 		}
 
-		head.key, head.value = head.Prev()
+		head.key, head.value = w.step(head.Cursor)
+	}
+
+	return
+}
+
+// idCandidates returns posting keys of documents whose IDs are within [lo, hi) in
+// descending order, or nil if there are more than limit of them.
+func idCandidates(bkNs *bbolt.Bucket, l keyLayout, lo, hi []byte, limit int) [][]byte {
+	candidates := [][]byte{}
+	c := bkNs.Bucket(idBucket).Cursor()
+	k, v := c.First()
+	if len(lo) > 0 {
+		k, v = c.Seek(lo)
+	}
+	for ; len(k) > 0 && (hi == nil || bytes.Compare(k, hi) < 0); k, v = c.Next() {
+		if len(candidates) >= limit {
+			return nil
+		}
+		index, score, secondary, _ := l.payloadHeader(v)
+		candidates = append(candidates, l.postingKey(score, secondary, index))
+	}
+	sort.Slice(candidates, func(i, j int) bool { return bytes.Compare(candidates[i], candidates[j]) > 0 })
+	return candidates
+}
+
+// maxIDCandidates is the most documents an ID filter may select to be evaluated by
+// candidateSearch.
+const maxIDCandidates = 10000
+
+func inRange(id, lo, hi []byte) bool {
+	return bytes.Compare(id, lo) >= 0 && (hi == nil || bytes.Compare(id, hi) < 0)
+}
+
+// candidateSearch matches chars against candidates (descending posting keys) by
+// looking up their postings directly.
+func candidateSearch(bkNs *bbolt.Bucket, l keyLayout, chars []*segchars, candidates [][]byte, start []byte, metrics *Metrics, f func([]byte, [][2]uint16) bool, ddl int64) {
+	w := metrics.walk(l)
+	var buckets [][]*bbolt.Bucket
+	for _, sc := range chars {
+		var bks []*bbolt.Bucket
+		for _, r := range sc.Chars {
+			bk := bkNs.Bucket(runeBucket(uint32(r)))
+			if bk == nil {
+				return
+			}
+			bks = append(bks, bk)
+		}
+		buckets = append(buckets, bks)
+	}
+	all := len(chars) == 1 && len(chars[0].Chars) == 1 && chars[0].Chars[0] == 0
+
+	var segs [][2]uint16
+	var values [][]byte
+NEXT:
+	for i := range candidates {
+		// Each candidate costs several lookups, so the clock is checked every time.
+		if ddl > 0 && time.Now().UnixNano() > ddl {
+			metrics.Timeout = true
+			return
+		}
+		key := candidates[i]
+		if w.asc {
+			key = candidates[len(candidates)-1-i]
+		}
+		if len(start) > 0 && w.cmp(key, start) < 0 || !w.within(key) {
+			continue
+		}
+		metrics.Seek++
+		if all {
+			if !f(key, nil) {
+				return
+			}
+			continue
+		}
+		segs = segs[:0]
+		for i, seg := range chars {
+			values = values[:0]
+			for _, bk := range buckets[i] {
+				v := bk.Get(key)
+				if v == nil {
+					continue NEXT
+				}
+				values = append(values, v)
+			}
+			span, match := seg.match(values, metrics)
+			if !match {
+				metrics.Miss++
+				continue NEXT
+			}
+			segs = append(segs, span)
+		}
+		metrics.Scan++
+		if !f(key, segs) {
+			return
+		}
+	}
+}
+
+func (seg *segchars) match(values [][]byte, metrics *Metrics) (span [2]uint16, match bool) {
+	missThreshold := metrics.FuzzyMiss
+	dist := metrics.FuzzyDist
+	if missThreshold >= len(values)/2 {
+		missThreshold = len(values) / 2
 	}
+	if len(values) <= 4 {
+		missThreshold = 0
+	}
+	if !seg.Fuzzy {
+		missThreshold = 0
+		dist = 0
+	}
+
+	array16.Foreach(values[0], func(pos uint16) bool {
+		misses := 0
+		minPos, maxPos := pos, array16.AddSat(pos, uint16(len(values))-1)
+		for i := 1; i < len(values); i++ {
+			pos := array16.AddSat(pos, uint16(i))
+			realPos, ok := array16.Contains(values[i], array16.SubSat(pos, dist), array16.AddSat(pos, dist))
+			if !ok {
+				misses++
+				if misses > missThreshold {
+					return true
+				}
+				continue
+			}
+			if realPos > maxPos {
+				maxPos = realPos
+			}
+			if realPos < minPos {
+				minPos = realPos
+			}
+		}
 
+		// Found
+		match = true
+		span = [2]uint16{minPos, maxPos}
+		return false
+	})
 	return
 }
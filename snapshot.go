@@ -0,0 +1,102 @@
+package like
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coyove/bbolt"
+)
+
+var ErrSnapshotExpired = errors.New("snapshot is expired or closed")
+
+// Snapshot keeps one read transaction so that pages of a search are consistent with
+// each other, regardless of writes in between. The transaction is released after
+// lease passes without the snapshot being used, or when closed. While it is open, old
+// pages can't be reused, and a commit which has to grow the file blocks, holding every
+// other writer, until the snapshot expires or is closed.
+type Snapshot struct {
+	db    *DB
+	lease time.Duration
+	mu    sync.Mutex
+	tx    *bbolt.Tx
+	timer *time.Timer
+}
+
+func (db *DB) Snapshot(lease time.Duration) (*Snapshot, error) {
+	if lease <= 0 {
+		return nil, fmt.Errorf("invalid snapshot lease %v", lease)
+	}
+	tx, err := db.begin(false)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{db: db, lease: lease, tx: tx}
+	s.mu.Lock()
+	s.timer = time.AfterFunc(lease, s.Close)
+	s.mu.Unlock()
+
+	db.mu.Lock()
+	if db.snapshots == nil {
+		db.snapshots = map[*Snapshot]bool{}
+	}
+	db.snapshots[s] = true
+	db.mu.Unlock()
+	return s, nil
+}
+
+// Search is DB.Search on the snapshot, metrics.Error is set to ErrSnapshotExpired
+// if the snapshot is no longer usable.
+func (s *Snapshot) Search(query string, start []byte, n int, metrics *Metrics) (res []Document, next []byte) {
+	if metrics == nil {
+		metrics = &Metrics{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tx == nil {
+		metrics.Error = ErrSnapshotExpired.Error()
+		return
+	}
+	s.timer.Reset(s.lease)
+	return s.db.search(s.tx, query, start, n, metrics)
+}
+
+// SearchPage is DB.SearchPage on the snapshot, it returns ErrSnapshotExpired if the
+// snapshot is no longer usable.
+func (s *Snapshot) SearchPage(query string, cursor *SearchCursor, n int, metrics *Metrics) (res []Document, prev, next *SearchCursor, err error) {
+	s.mu.Lock()
+	if s.tx == nil {
+		s.mu.Unlock()
+		return nil, nil, nil, ErrSnapshotExpired
+	}
+	hash := s.db.searchHash(s.tx, query, metrics)
+	s.mu.Unlock()
+	return s.db.searchPage(hash, s.Search, query, cursor, n, metrics)
+}
+
+func (s *Snapshot) Close() {
+	s.mu.Lock()
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+		s.timer.Stop()
+	}
+	s.mu.Unlock()
+
+	s.db.mu.Lock()
+	delete(s.db.snapshots, s)
+	s.db.mu.Unlock()
+}
+
+func (db *DB) closeSnapshots() {
+	db.mu.Lock()
+	var snapshots []*Snapshot
+	for s := range db.snapshots {
+		snapshots = append(snapshots, s)
+	}
+	db.mu.Unlock()
+	for _, s := range snapshots {
+		s.Close()
+	}
+}